@@ -0,0 +1,406 @@
+package btree
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+var ErrNotFound = errors.New("Key not found")
+
+// Committed version of the tree, identified by its header offset in a
+// generation of the file. Compaction starts a new generation, in which
+// offsets of the previous one mean nothing.
+type Version struct {
+	Generation uint64
+	Offset     int64
+}
+
+// Summary of the current tree, counted by walking it. Item counts are
+// only reported here, since they cannot be kept as running totals in
+// Stats: items expire as time passes, without any write.
+type Info struct {
+	// Latest committed version and its header
+	Version    Version
+	Format     uint16
+	Features   uint32
+	Comparator string
+	FileSize   int64
+	// Node counts of the current root
+	Depth   int
+	KPNodes int
+	KVNodes int
+	Items   int
+	// Items that expired but are not purged by compaction yet,
+	// included in Items
+	Expired int
+	// Tombstones of deleted keys, included in Items
+	Tombstones int
+}
+
+func (tree *btree) Get(k Key) (Value, error) {
+	return tree.GetContext(context.Background(), k)
+}
+
+// Get that stops with ctx.Err() once ctx is done
+func (tree *btree) GetContext(ctx context.Context, k Key) (Value, error) {
+	var found *kv
+
+	rq := &QueryRequest{
+		Keys: []*Key{&k},
+		Callback: func(itm kv) {
+			if !itm.missing {
+				found = &itm
+			}
+		},
+		ctx: ctx,
+	}
+
+	err := tree.query(rq)
+	if err != nil {
+		return nil, err
+	}
+
+	if found == nil {
+		return nil, ErrNotFound
+	}
+
+	return found.v, nil
+}
+
+// Apply operations in a single modification of the tree. All writes
+// go through it. Once ctx is done the modification is abandoned with
+// ctx.Err(), leaving the tree unchanged.
+func (tree *btree) modify_ctx(ctx context.Context, ops ...Operation) ([]Operation, error) {
+	err := ctxErr(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rq := &ModifyRequest{ops: ops, ctx: ctx}
+	err = tree.modify(rq)
+	if err != nil {
+		return nil, err
+	}
+
+	return rq.ops, nil
+}
+
+// Insert or update a key, visible to readers after Flush
+func (tree *btree) Insert(k Key, v Value) error {
+	return tree.InsertContext(context.Background(), k, v)
+}
+
+// Insert that is abandoned with ctx.Err() once ctx is done
+func (tree *btree) InsertContext(ctx context.Context, k Key, v Value) error {
+	_, err := tree.modify_ctx(ctx, Operation{itm: kv{k: k, v: v}, op: OP_INSERT})
+	return err
+}
+
+// Insert or update a key that expires after ttl. Expired keys are
+// hidden from reads and dropped by compaction, Info reports how many
+// are left to drop.
+func (tree *btree) InsertWithTTL(k Key, v Value, ttl time.Duration) error {
+	return tree.InsertWithTTLContext(context.Background(), k, v, ttl)
+}
+
+// InsertWithTTL that is abandoned with ctx.Err() once ctx is done
+func (tree *btree) InsertWithTTLContext(ctx context.Context, k Key, v Value, ttl time.Duration) error {
+	tree.owner().expiring = true
+	_, err := tree.modify_ctx(ctx, Operation{itm: kv{k: k, v: v, expires: timeNow().Add(ttl).UnixNano()}, op: OP_INSERT})
+	return err
+}
+
+// Remove a key, visible to readers after Flush
+func (tree *btree) Remove(k Key) error {
+	return tree.RemoveContext(context.Background(), k)
+}
+
+// Remove that is abandoned with ctx.Err() once ctx is done
+func (tree *btree) RemoveContext(ctx context.Context, k Key) error {
+	_, err := tree.modify_ctx(ctx, Operation{itm: kv{k: k}, op: OP_DELETE})
+	return err
+}
+
+// Apply a single operation and report whether it changed the tree
+func (tree *btree) apply_ctx(ctx context.Context, op Operation) (bool, error) {
+	ops, err := tree.modify_ctx(ctx, op)
+	if err != nil {
+		return false, err
+	}
+
+	return ops[0].applied, nil
+}
+
+// Replace the value of a key only if it currently equals old
+func (tree *btree) CompareAndSwap(k Key, old, new Value) (bool, error) {
+	return tree.CompareAndSwapContext(context.Background(), k, old, new)
+}
+
+// CompareAndSwap that is abandoned with ctx.Err() once ctx is done
+func (tree *btree) CompareAndSwapContext(ctx context.Context, k Key, old, new Value) (bool, error) {
+	return tree.apply_ctx(ctx, Operation{itm: kv{k: k, v: new}, op: OP_CAS, expected: old})
+}
+
+// Insert a key only if it is not present
+func (tree *btree) PutIfAbsent(k Key, v Value) (bool, error) {
+	return tree.PutIfAbsentContext(context.Background(), k, v)
+}
+
+// PutIfAbsent that is abandoned with ctx.Err() once ctx is done
+func (tree *btree) PutIfAbsentContext(ctx context.Context, k Key, v Value) (bool, error) {
+	return tree.apply_ctx(ctx, Operation{itm: kv{k: k, v: v}, op: OP_PUT_IF_ABSENT})
+}
+
+// Remove a key only if its value equals v
+func (tree *btree) DeleteIfEquals(k Key, v Value) (bool, error) {
+	return tree.DeleteIfEqualsContext(context.Background(), k, v)
+}
+
+// DeleteIfEquals that is abandoned with ctx.Err() once ctx is done
+func (tree *btree) DeleteIfEqualsContext(ctx context.Context, k Key, v Value) (bool, error) {
+	return tree.apply_ctx(ctx, Operation{itm: kv{k: k}, op: OP_DELETE_IF_EQUALS, expected: v})
+}
+
+// Commit modifications by writing a new header
+func (tree *btree) Flush() error {
+	return tree.FlushContext(context.Background())
+}
+
+// Flush that fails with ctx.Err(), committing nothing, if ctx is done
+// before the header is written
+func (tree *btree) FlushContext(ctx context.Context) error {
+	err := ctxErr(ctx)
+	if err != nil {
+		return err
+	}
+
+	return tree.write_header()
+}
+
+// Call fn for items between start and end inclusive, in key order,
+// until it returns false. A nil start or end leaves the range open.
+func (tree *btree) Scan(start, end Key, fn func(Key, Value) bool) error {
+	return tree.ScanContext(context.Background(), start, end, fn)
+}
+
+// Scan that stops with ctx.Err() once ctx is done
+func (tree *btree) ScanContext(ctx context.Context, start, end Key, fn func(Key, Value) bool) error {
+	var keys []*Key
+
+	switch {
+	case start == nil:
+		keys = append(keys, nil)
+	default:
+		keys = append(keys, &start)
+	}
+
+	switch {
+	case end == nil:
+		keys = append(keys, nil)
+	default:
+		keys = append(keys, &end)
+	}
+
+	var rq *QueryRequest
+	rq = &QueryRequest{
+		Keys: keys,
+		Callback: func(itm kv) {
+			if !rq.stop && !fn(itm.k, itm.v) {
+				rq.stop = true
+			}
+		},
+		Range: true,
+		ctx:   ctx,
+	}
+
+	return tree.query(rq)
+}
+
+// Items fetched at a time by Iterator
+const iterBatch = 256
+
+// Iterator over a snapshot, fetched in batches resuming after the last
+// key returned
+type treeIter struct {
+	snap  *btree
+	items []kv
+	last  *Key
+	done  bool
+	err   error
+}
+
+func (it *treeIter) fetch() {
+	var rq *QueryRequest
+
+	start := it.last
+	rq = &QueryRequest{
+		Keys: []*Key{start, nil},
+		Callback: func(itm kv) {
+			if rq.stop || start != nil && it.snap.cmp(&itm.k, start) == 0 {
+				return
+			}
+
+			it.items = append(it.items, itm)
+			if len(it.items) == iterBatch {
+				rq.stop = true
+			}
+		},
+		Range: true,
+	}
+
+	it.err = it.snap.query(rq)
+	if it.err != nil || len(it.items) < iterBatch {
+		it.done = true
+	}
+}
+
+func (it *treeIter) HasNext() bool {
+	if len(it.items) == 0 && !it.done {
+		it.fetch()
+	}
+
+	return len(it.items) > 0
+}
+
+func (it *treeIter) Next() (Key, Value) {
+	itm := it.items[0]
+	it.items = it.items[1:]
+	it.last = &itm.k
+	return itm.k, itm.v
+}
+
+// Deprecated: use Scan. Iterate over all items of the current root in
+// key order, iteration ends early if the tree cannot be read.
+func (tree *btree) Iterator() BtreeIter {
+	return &treeIter{snap: tree.snapshot()}
+}
+
+// Deprecated: the ordering is not recorded in the file. Register it
+// with RegisterComparator and set Config.Comparator instead. It is
+// ignored by a non-empty tree, and the file has to be reopened with the
+// same ordering given by Config.Comparator.
+func (tree *btree) SetComparator(cmp func(Key, Key) int) {
+	if tree.root != nil {
+		return
+	}
+
+	tree.cmp = func(k1, k2 *Key) int {
+		return cmp(*k1, *k2)
+	}
+	tree.cmpName = UNREGISTERED_COMPARATOR
+}
+
+// Deprecated: trees are bound to their file by the package level
+// Open, this only succeeds if w is that file.
+func (tree *btree) Open(w io.Writer) error {
+	name := tree.owner().file.Name()
+	if f, ok := w.(*os.File); ok && f.Name() == name {
+		return nil
+	}
+
+	return errors.New("Btree is already bound to " + name)
+}
+
+// Rewrite live items into a new file and commit
+func (tree *btree) Compact() error {
+	return tree.CompactContext(context.Background())
+}
+
+// Compact that is abandoned with ctx.Err() once ctx is done, leaving
+// the file unchanged
+func (tree *btree) CompactContext(ctx context.Context) error {
+	err := tree.compact_ctx(ctx)
+	if err != nil {
+		return err
+	}
+
+	return tree.write_header()
+}
+
+// Summarize the current tree. Every node is read, so the cost grows
+// with the size of the tree.
+func (tree *btree) Info() (Info, error) {
+	var info Info
+
+	st, err := tree.file.Stat()
+	if err != nil {
+		return info, err
+	}
+	info.FileSize = st.Size()
+	info.Comparator = tree.cmpName
+
+	o := tree.owner()
+	h, pos, err := o.find_header(o.offset)
+	if err == nil {
+		info.Version = Version{o.generation, pos}
+		info.Format = h.version
+		info.Features = h.features
+	}
+
+	if tree.root == nil {
+		return info, nil
+	}
+
+	err = tree.count_nodes(&info, v2p(tree.root.kvlist[0].v), 1)
+	return info, err
+}
+
+// Walk the subtree at diskPos and update node counts
+func (tree *btree) count_nodes(info *Info, diskPos int64, depth int) error {
+	n, err := tree.readNode(diskPos)
+	if err != nil {
+		return err
+	}
+
+	if depth > info.Depth {
+		info.Depth = depth
+	}
+
+	if n.ntype == kvnode {
+		info.KVNodes++
+		info.Items += len(n.kvlist)
+		for _, itm := range n.kvlist {
+			if itm.expired() {
+				info.Expired++
+			}
+			if itm.tombstone() {
+				info.Tombstones++
+			}
+		}
+		return nil
+	}
+
+	info.KPNodes++
+	for _, itm := range n.kvlist {
+		err = tree.count_nodes(info, v2p(itm.v), depth+1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List committed versions, newest first
+func (tree *btree) Versions() ([]Version, error) {
+	var versions []Version
+
+	o := tree.owner()
+	pos := o.offset
+	for {
+		h, hpos, err := tree.find_header(pos)
+		if err != nil {
+			break
+		}
+
+		if h.version == FORMAT_VERSION {
+			versions = append(versions, Version{o.generation, hpos})
+		}
+		pos = hpos - 1
+	}
+
+	return versions, nil
+}
@@ -0,0 +1,268 @@
+package btree
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPublicApi(t *testing.T) {
+	os.Remove(TEST_FILE)
+	tree, err := Open(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+	defer tree.Close()
+
+	for i := 0; i < 10; i++ {
+		err = tree.Insert(make_key(i), make_value(i))
+		if err != nil {
+			t.Fatalf("Insert failed (%s)", err)
+		}
+	}
+
+	err = tree.Remove(make_key(3))
+	if err != nil {
+		t.Fatalf("Remove failed (%s)", err)
+	}
+
+	err = tree.Flush()
+	if err != nil {
+		t.Fatalf("Flush failed (%s)", err)
+	}
+
+	v, err := tree.Get(make_key(4))
+	if err != nil || string(v) != string(make_value(4)) {
+		t.Errorf("Unexpected value for key_4 %s (%v)", string(v), err)
+	}
+
+	_, err = tree.Get(make_key(3))
+	if err != ErrNotFound {
+		t.Errorf("Expected removed key to be not found (%v)", err)
+	}
+
+	received := []kv{}
+	err = tree.Scan(make_key(2), make_key(7), func(k Key, v Value) bool {
+		received = append(received, kv{k: k, v: v})
+		return len(received) < 3
+	})
+	if err != nil {
+		t.Fatalf("Scan failed (%s)", err)
+	}
+
+	expected := []int{2, 4, 5}
+	if len(received) != len(expected) {
+		t.Fatalf("Expected %d items from scan, found %d", len(expected), len(received))
+	}
+	for i, id := range expected {
+		if !equals(received[i], kv{k: make_key(id), v: make_value(id)}) {
+			t.Errorf("Unexpected item from scan %s", string(received[i].k))
+		}
+	}
+
+	info, err := tree.Info()
+	if err != nil {
+		t.Fatalf("Info failed (%s)", err)
+	}
+	if info.Items != 9 || info.Format != FORMAT_VERSION {
+		t.Errorf("Unexpected info %+v", info)
+	}
+
+	versions, _ := tree.Versions()
+	if len(versions) != 1 || versions[0] != info.Version {
+		t.Errorf("Unexpected versions %v", versions)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	os.Remove(TEST_FILE)
+	defer os.Remove(TEST_FILE)
+
+	config := DefaultConfig()
+	config.BlobThreshold = 16
+	tree, err := Open(TEST_FILE, config)
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		tree.Insert(make_key(i), make_value(i))
+	}
+	tree.InsertWithTTL(make_key(3), make_value(3), time.Minute)
+	tree.InsertWithTTL(make_key(4), Value("a value stored as a blob"), time.Hour)
+	tree.Flush()
+	tree.Close()
+
+	tree, err = Open(TEST_FILE, config)
+	if err != nil {
+		t.Fatalf("Failed to reopen tree (%s)", err)
+	}
+	defer tree.Close()
+
+	info, _ := tree.Info()
+	if info.Features&FEATURE_EXPIRY == 0 || info.Expired != 0 {
+		t.Errorf("Unexpected expiry info %+v", info)
+	}
+
+	v, err := tree.Get(make_key(4))
+	if err != nil || string(v) != "a value stored as a blob" {
+		t.Errorf("Unexpected value before expiry %s (%v)", v, err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, err = tree.Get(make_key(3)); err != ErrNotFound {
+		t.Errorf("Expected expired key to be hidden (%v)", err)
+	}
+
+	count := 0
+	tree.Scan(nil, nil, func(k Key, v Value) bool {
+		count++
+		return true
+	})
+	if count != 9 {
+		t.Errorf("Expected 9 items from scan, found %d", count)
+	}
+
+	info, _ = tree.Info()
+	if info.Items != 10 || info.Expired != 1 {
+		t.Errorf("Expected 1 of 10 items expired, found %d of %d", info.Expired, info.Items)
+	}
+
+	now = now.Add(time.Hour)
+	ok, _ := tree.PutIfAbsent(make_key(3), make_value(30))
+	if !ok {
+		t.Error("Expected PutIfAbsent on expired key to succeed")
+	}
+
+	err = tree.Compact()
+	if err != nil {
+		t.Fatalf("Compact failed (%s)", err)
+	}
+	info, _ = tree.Info()
+	if info.Items != 9 || info.Expired != 0 {
+		t.Errorf("Expected expired items purged, found %d of %d", info.Expired, info.Items)
+	}
+}
+
+func TestDeprecatedApi(t *testing.T) {
+	N := 1000
+	os.Remove(TEST_FILE)
+	defer os.Remove(TEST_FILE)
+
+	tree, err := Open(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+	defer tree.Close()
+
+	tree.SetComparator(compareKeyIds)
+	for i := N - 1; i >= 0; i-- {
+		tree.Insert(make_key(i), make_value(i))
+	}
+	tree.Flush()
+
+	// Spans several batches
+	i := 0
+	for it := tree.Iterator(); it.HasNext(); i++ {
+		k, v := it.Next()
+		if string(k) != string(make_key(i)) || string(v) != string(make_value(i)) {
+			t.Fatalf("Unexpected item %s/%s, expected %s", string(k), string(v), string(make_key(i)))
+		}
+	}
+	if i != N {
+		t.Errorf("Expected %d items from iterator, found %d", N, i)
+	}
+
+	f, _ := os.Open(TEST_FILE)
+	defer f.Close()
+	if tree.Open(f) != nil {
+		t.Errorf("Expected Open to accept the tree file")
+	}
+	if tree.Open(os.Stdout) == nil {
+		t.Errorf("Expected Open to reject another file")
+	}
+
+	// A non-empty tree keeps its ordering
+	tree.SetComparator(func(k1, k2 Key) int {
+		return compareKeyIds(k2, k1)
+	})
+	_, err = tree.Get(make_key(N / 3))
+	if err != nil {
+		t.Errorf("Expected SetComparator to be ignored by a non-empty tree (%s)", err)
+	}
+	tree.Close()
+
+	// The ordering is not recorded, so it has to be named on reopen
+	_, err = Open(TEST_FILE, DefaultConfig())
+	if err == nil {
+		t.Fatalf("Expected open without comparator to fail")
+	}
+
+	RegisterComparator("ids", compareKeyIds)
+	config := DefaultConfig()
+	config.Comparator = "ids"
+	tree, err = Open(TEST_FILE, config)
+	if err != nil {
+		t.Fatalf("Failed to reopen tree (%s)", err)
+	}
+	for i := 0; i < N; i++ {
+		if v, err := tree.Get(make_key(i)); err != nil || string(v) != string(make_value(i)) {
+			t.Fatalf("Expected %s after reopen, found %s (%v)", make_value(i), v, err)
+		}
+	}
+	tree.Insert(make_key(N), make_value(N))
+	tree.Flush()
+	tree.Close()
+
+	tree, err = Open(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Expected the comparator name recorded by the next commit (%s)", err)
+	}
+	tree.Close()
+}
+
+func TestExpiryRewrites(t *testing.T) {
+	now := time.Unix(1000, 0)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	os.Remove(TEST_FILE)
+	defer os.Remove(TEST_FILE)
+
+	tree, err := Open(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+	defer tree.Close()
+
+	zero := binary.LittleEndian.AppendUint64(nil, 0)
+	tree.InsertWithTTL(make_key(1), make_value(1), time.Minute)
+	tree.InsertWithTTL(make_key(2), zero, time.Minute)
+
+	// Swapped and merged values keep the expiry of the items they replace
+	ok, err := tree.CompareAndSwap(make_key(1), make_value(1), make_value(10))
+	if !ok || err != nil {
+		t.Fatalf("CompareAndSwap failed (%v)", err)
+	}
+	err = tree.Merge(MERGE_ADD, MergeOperand{Key: make_key(2), Operand: binary.LittleEndian.AppendUint64(nil, 1)})
+	if err != nil {
+		t.Fatalf("Merge failed (%s)", err)
+	}
+	tree.Flush()
+
+	if v, err := tree.Get(make_key(1)); err != nil || string(v) != string(make_value(10)) {
+		t.Errorf("Unexpected value after swap %s (%v)", v, err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	for i := 1; i <= 2; i++ {
+		if _, err = tree.Get(make_key(i)); err != ErrNotFound {
+			t.Errorf("Expected rewritten key %s to expire (%v)", make_key(i), err)
+		}
+	}
+}
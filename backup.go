@@ -0,0 +1,82 @@
+package btree
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// Write a consistent copy of the file up to the latest committed
+// header and return its version. Appends that are not committed yet
+// are left out, so the copy never has a torn tail.
+func (tree *btree) Backup(w io.Writer) (Version, error) {
+	return tree.Ship(w, Version{})
+}
+
+// Write only the bytes committed after the version of a previous
+// backup. If since is of another generation of the file, e.g. after
+// compaction, or does not name a header, a full backup is written
+// instead.
+func (tree *btree) BackupIncremental(w io.Writer, since Version) (Version, error) {
+	return tree.Ship(w, since)
+}
+
+// Create filename from a full backup followed by incremental backups
+// in the order they were taken. Incremental backups of another
+// generation than the one restored so far are rejected. The restored
+// file is verified against its final header and must not exist
+// already. It is removed again if the restore fails.
+func RestoreBackup(filename string, config Config, backups ...io.Reader) (Version, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return Version{}, err
+	}
+	f.Close()
+
+	v, err := restore_backup(filename, config, backups)
+	if err != nil {
+		os.Remove(filename)
+	}
+
+	return v, err
+}
+
+func restore_backup(filename string, config Config, backups []io.Reader) (Version, error) {
+	fl, err := OpenFollower(filename, config)
+	if err != nil {
+		return Version{}, err
+	}
+	defer fl.Close()
+
+	for _, r := range backups {
+		err = fl.Apply(r)
+		if err != nil {
+			return Version{}, err
+		}
+	}
+
+	if fl.Version() == (Version{}) {
+		return Version{}, errors.New("Backup has no committed version")
+	}
+
+	trees := []*btree{fl.tree}
+	for _, name := range fl.tree.tree_names(true) {
+		child, err := fl.tree.named(name, "")
+		if err != nil {
+			return Version{}, err
+		}
+		trees = append(trees, child)
+	}
+
+	for _, tree := range trees {
+		report, err := tree.Verify(VerifyOptions{Checksums: true})
+		if err != nil {
+			return Version{}, err
+		}
+		if !report.Ok() {
+			return Version{}, errors.New("Restored backup failed verification: " + report.Violations[0].String())
+		}
+	}
+
+	return fl.Version(), nil
+}
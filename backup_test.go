@@ -0,0 +1,139 @@
+package btree
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+const RESTORE_FILE = "restore.tree"
+
+func TestBackup(t *testing.T) {
+	os.Remove(TEST_FILE)
+	os.Remove(RESTORE_FILE)
+	defer os.Remove(TEST_FILE)
+	defer os.Remove(RESTORE_FILE)
+
+	tree, err := Open(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+	defer tree.Close()
+
+	users, _ := tree.Tree("users", "")
+	for i := 0; i < 50; i++ {
+		tree.Insert(make_key(i), make_value(i))
+		users.Insert(make_key(i), make_value(i))
+	}
+	tree.Flush()
+
+	full := new(bytes.Buffer)
+	v1, err := tree.Backup(full)
+	if err != nil {
+		t.Fatalf("Backup failed (%s)", err)
+	}
+
+	// Uncommitted appends are not part of a backup
+	for i := 50; i < 100; i++ {
+		tree.Insert(make_key(i), make_value(i))
+	}
+	tree.Flush()
+	tree.Remove(make_key(0))
+
+	incr := new(bytes.Buffer)
+	v2, err := tree.BackupIncremental(incr, v1)
+	if err != nil {
+		t.Fatalf("Incremental backup failed (%s)", err)
+	}
+	if v2.Offset <= v1.Offset || incr.Len() >= full.Len()+int(v2.Offset-v1.Offset) {
+		t.Errorf("Unexpected incremental backup of %d bytes from %d to %d", incr.Len(), v1, v2)
+	}
+
+	_, err = RestoreBackup(RESTORE_FILE, DefaultConfig(), bytes.NewReader(incr.Bytes()))
+	if err == nil {
+		t.Error("Expected restore of incremental backup alone to fail")
+	}
+
+	v, err := RestoreBackup(RESTORE_FILE, DefaultConfig(), full, incr)
+	if err != nil || v != v2 {
+		t.Fatalf("Restore failed at %d (%v)", v, err)
+	}
+
+	restored, err := Open(RESTORE_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open restored tree (%s)", err)
+	}
+	defer restored.Close()
+
+	info, _ := restored.Info()
+	if info.Items != 100 {
+		t.Errorf("Expected 100 restored items, found %d", info.Items)
+	}
+	ru, _ := restored.Tree("users", "")
+	if info, _ = ru.Info(); info.Items != 50 {
+		t.Errorf("Expected 50 restored items in named tree, found %d", info.Items)
+	}
+
+	_, err = RestoreBackup(RESTORE_FILE, DefaultConfig(), full)
+	if err == nil {
+		t.Error("Expected restore over an existing file to fail")
+	}
+}
+
+func TestBackupGenerations(t *testing.T) {
+	other := TEST_FILE + ".other"
+	os.Remove(TEST_FILE)
+	os.Remove(other)
+	os.Remove(RESTORE_FILE)
+	defer os.Remove(TEST_FILE)
+	defer os.Remove(other)
+	defer os.Remove(RESTORE_FILE)
+
+	tree, err := Open(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+	defer tree.Close()
+
+	tree2, err := Open(other, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+	defer tree2.Close()
+
+	// Both files commit their first version at the same offset
+	tree.Insert(Key("a"), Value("1"))
+	tree.Flush()
+	tree2.Insert(Key("a"), Value("2"))
+	tree2.Flush()
+
+	full := new(bytes.Buffer)
+	v1, _ := tree.Backup(full)
+	v2, _ := tree2.Backup(new(bytes.Buffer))
+	if v1.Offset != v2.Offset {
+		t.Fatalf("Expected versions at the same offset, found %v and %v", v1, v2)
+	}
+
+	tree2.Insert(Key("b"), Value("2"))
+	tree2.Flush()
+	incr := new(bytes.Buffer)
+	tree2.BackupIncremental(incr, v2)
+
+	_, err = RestoreBackup(RESTORE_FILE, DefaultConfig(), bytes.NewReader(full.Bytes()), incr)
+	if err == nil {
+		t.Errorf("Expected restore of backups of different generations to fail")
+	}
+
+	// After compaction the next incremental backup is a full one
+	tree.Compact()
+	incr.Reset()
+	_, err = tree.BackupIncremental(incr, v1)
+	if err != nil {
+		t.Fatalf("Incremental backup failed (%s)", err)
+	}
+
+	v, err := RestoreBackup(RESTORE_FILE, DefaultConfig(), bytes.NewReader(full.Bytes()), incr)
+	if err != nil || v.Generation == v1.Generation {
+		t.Errorf("Expected restore at a new generation, found %v (%v)", v, err)
+	}
+}
@@ -0,0 +1,86 @@
+package btree
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+// Write value as a separate record and return a pointer kv for it
+func (tree *btree) writeBlob(itm *kv) (*kv, error) {
+	o := tree.owner()
+	pos := o.offset
+	n, err := tree.file.WriteAt(itm.v, pos)
+	if err != nil {
+		return nil, err
+	}
+	o.offset = pos + int64(n)
+
+	ptr := new(bytes.Buffer)
+	ptr.Write(p2v(pos))
+	ptr.Write(p2v(int64(n)))
+
+	return &kv{k: itm.k, v: Value(ptr.Bytes()), flags: kvBlob, expires: itm.expires}, nil
+}
+
+// Reader for the value referred by a blob pointer
+func (tree *btree) blobReader(ptr Value) *io.SectionReader {
+	return io.NewSectionReader(tree.file, v2p(ptr[:8]), v2p(ptr[8:]))
+}
+
+// Read the complete value referred by a blob pointer
+func (tree *btree) readBlob(ptr Value) (Value, error) {
+	buf, err := ioutil.ReadAll(tree.blobReader(ptr))
+	return Value(buf), err
+}
+
+// Value of an item, read from its blob if stored out of line
+func (tree *btree) resolve(itm *kv) (Value, error) {
+	if itm.flags&kvBlob != 0 {
+		return tree.readBlob(itm.v)
+	}
+
+	return itm.v, nil
+}
+
+// Move value out of line if it is larger than the configured threshold
+func (tree *btree) prepare(itm *kv) (*kv, error) {
+	if tree.config.BlobThreshold == 0 || len(itm.v) <= int(tree.config.BlobThreshold) {
+		if len(itm.v) > valueLenMask {
+			return nil, ErrValueTooLarge
+		}
+		return itm, nil
+	}
+
+	return tree.writeBlob(itm)
+}
+
+// Streaming access to the value of a key
+func (tree *btree) GetReader(k Key) (io.ReadCloser, error) {
+	var found *kv
+
+	rq := &QueryRequest{
+		Keys: []*Key{&k},
+		Callback: func(itm kv) {
+			if !itm.missing {
+				found = &itm
+			}
+		},
+		raw: true,
+	}
+
+	err := tree.query(rq)
+	if err != nil {
+		return nil, err
+	}
+
+	if found == nil {
+		return nil, ErrNotFound
+	}
+
+	if found.flags&kvBlob != 0 {
+		return ioutil.NopCloser(tree.blobReader(found.v)), nil
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(found.v)), nil
+}
@@ -3,8 +3,19 @@ package btree
 // An MVCC Btree implementation
 
 import (
+	"context"
+	"errors"
 	"io"
 	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_KV_CHUNKSIZE = 4096
+	DEFAULT_KP_CHUNKSIZE = 4096
+	DEFAULT_BULK_BUFSIZE = 64 << 20
+	DEFAULT_BULK_FANIN   = 64
 )
 
 type BtreeIter interface {
@@ -12,20 +23,118 @@ type BtreeIter interface {
 	Next() (Key, Value)
 }
 
+// Iterator that also returns the expiry time of each item, zero if the
+// item does not expire. BulkLoad keeps the expiry of items read from
+// iterators implementing it.
+type BtreeExpiryIter interface {
+	BtreeIter
+	NextExpiry() (Key, Value, time.Time)
+}
+
 type Btree interface {
+	// Deprecated: trees are bound to their file by the package level Open
 	Open(io.Writer) error
 	Close() error
 	Flush() error
+	FlushContext(ctx context.Context) error
+	// Deprecated: use RegisterComparator and Config.Comparator
 	SetComparator(cmp func(Key, Key) int)
 	Insert(Key, Value) error
+	InsertContext(ctx context.Context, k Key, v Value) error
+	InsertWithTTL(k Key, v Value, ttl time.Duration) error
+	InsertWithTTLContext(ctx context.Context, k Key, v Value, ttl time.Duration) error
+	Merge(name string, operands ...MergeOperand) error
+	MergeContext(ctx context.Context, name string, operands ...MergeOperand) error
 	Remove(Key) error
+	RemoveContext(ctx context.Context, k Key) error
+	CompareAndSwap(k Key, old, new Value) (bool, error)
+	CompareAndSwapContext(ctx context.Context, k Key, old, new Value) (bool, error)
+	PutIfAbsent(Key, Value) (bool, error)
+	PutIfAbsentContext(ctx context.Context, k Key, v Value) (bool, error)
+	DeleteIfEquals(Key, Value) (bool, error)
+	DeleteIfEqualsContext(ctx context.Context, k Key, v Value) (bool, error)
+	Update(fn func(tx *Tx) error) error
 	Get(Key) (Value, error)
+	GetContext(ctx context.Context, k Key) (Value, error)
+	GetReader(Key) (io.ReadCloser, error)
+	Scan(start, end Key, fn func(Key, Value) bool) error
+	// Deprecated: use Scan
 	Iterator() BtreeIter
+	ScanContext(ctx context.Context, start, end Key, fn func(Key, Value) bool) error
+	BulkLoad(BtreeIter) error
+	Dump(w io.Writer, format int) error
+	Restore(r io.Reader) error
+	Compact() error
+	CompactContext(ctx context.Context) error
+	Info() (Info, error)
+	Versions() ([]Version, error)
+	Verify(VerifyOptions) (*VerifyReport, error)
+	DumpStructure(w io.Writer, format int, opts StructureOptions) error
+	Stats() Stats
+	Changes(since uint64, fn func(Change) bool) error
+	LastSeq() (uint64, error)
+	Watch(ctx context.Context, keys KeyRange) <-chan Event
+	Ship(w io.Writer, since Version) (Version, error)
+	ServeReplica(rw io.ReadWriter) error
+	Backup(w io.Writer) (Version, error)
+	BackupIncremental(w io.Writer, since Version) (Version, error)
+	RollbackTo(version Version, truncate bool) error
+	Diff(oldVersion, newVersion Version, fn func(DiffEntry) bool) error
+	Tombstones(start, end Key, fn func(Tombstone) bool) error
+	Tree(name, comparator string) (Btree, error)
+	TreeNames() []string
 }
 
 type Config struct {
 	kvChunkSize uint32
 	kpChunkSize uint32
+	// Optional codec used to compress node payloads
+	Codec Codec
+	// Values larger than this are stored out of line, 0 uses the
+	// threshold recorded in the file or disables blobs for new files
+	BlobThreshold uint32
+	// Registered comparator name, defaults to the one recorded in the file
+	Comparator string
+	// Memory used for sorting runs during bulk load, 0 uses the default
+	BulkBufferSize uint32
+	// Runs merged at once during bulk load, 0 uses the default. More
+	// runs are merged in several passes.
+	BulkMergeFanIn int
+	// Maintain a by-sequence index of updates, see Changes. Files that
+	// already have one keep tracking regardless of this setting.
+	TrackChanges bool
+	// Leave tombstones for deleted keys, see Tombstones. Files that
+	// have them keep this mode.
+	Tombstones bool
+	// Age after which compaction purges tombstones, 0 keeps them
+	TombstoneRetention time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		kvChunkSize: DEFAULT_KV_CHUNKSIZE,
+		kpChunkSize: DEFAULT_KP_CHUNKSIZE,
+	}
+}
+
+// Statistics of the nodes written to the file since it was created or
+// compacted. Counts of the items stored, including expired ones, are
+// reported by Info, which walks the whole tree to count them.
+type Stats struct {
+	// Number of nodes stored compressed
+	CompressedNodes uint64
+	// Node payload bytes before and after compression
+	RawBytes    uint64
+	StoredBytes uint64
+}
+
+// Ratio of stored to raw payload bytes, 1 if nothing was compressed
+func (s Stats) CompressionRatio() float64 {
+	if s.RawBytes == 0 {
+		return 1
+	}
+
+	return float64(s.StoredBytes) / float64(s.RawBytes)
 }
 
 type btree struct {
@@ -34,4 +143,161 @@ type btree struct {
 	config Config
 	root   *node
 	cmp    func(*Key, *Key) int
+	stats  Stats
+	// Name of the registered comparator in use
+	cmpName string
+	// Named trees share the file of their parent
+	parent *btree
+	name   string
+	trees  map[string]*btree
+	// By-sequence index and the last sequence number assigned
+	byseq *btree
+	seq   uint64
+	// Highest sequence numbers of the trees recorded in the header
+	seqs map[string]uint64
+	// Subscribers and the events to deliver on the next commit
+	watchLock sync.Mutex
+	watchers  []*watcher
+	events    []Event
+	// Version and end of the latest committed header, read by shipping
+	commitLock sync.Mutex
+	commit     Version
+	commitEnd  int64
+	// Generation of the file, see Version
+	generation uint64
+	// Serializes transactions
+	txLock sync.Mutex
+	// Items with an expiry time were written
+	expiring bool
+}
+
+// Open a btree file, creating it if it does not exist
+func Open(filename string, config Config) (Btree, error) {
+	tree, err := open_file(filename, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return tree, nil
+}
+
+func open_file(filename string, config Config) (*btree, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := &btree{
+		file:    f,
+		config:  config,
+		cmpName: config.Comparator,
+	}
+
+	err = tree.open(false)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return tree, nil
+}
+
+// Load the latest header, if any, and set up the comparator
+func (tree *btree) open(legacy bool) error {
+	st, err := tree.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if st.Size() == 0 {
+		tree.generation = new_generation()
+	} else {
+		err = tree.load_header(legacy)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case tree.cmpName != UNREGISTERED_COMPARATOR:
+			if tree.config.Comparator != "" && tree.config.Comparator != tree.cmpName {
+				return errors.New("Comparator mismatch: file uses " + tree.cmpName +
+					", requested " + tree.config.Comparator)
+			}
+		case tree.config.Comparator == "":
+			return errors.New("File was written with an unregistered comparator, set Config.Comparator")
+		default:
+			tree.cmpName = tree.config.Comparator
+		}
+	}
+
+	if tree.config.kvChunkSize == 0 {
+		tree.config.kvChunkSize = DEFAULT_KV_CHUNKSIZE
+		tree.config.kpChunkSize = DEFAULT_KP_CHUNKSIZE
+	}
+
+	if tree.cmpName == "" {
+		tree.cmpName = DEFAULT_COMPARATOR
+	}
+
+	tree.cmp, err = lookupComparator(tree.cmpName)
+	return err
+}
+
+// Rewrite a file written in a legacy format into the current format
+func Upgrade(filename string, config Config) error {
+	f, err := os.OpenFile(filename, os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	tree := &btree{
+		file:    f,
+		config:  config,
+		cmpName: config.Comparator,
+	}
+
+	defer tree.Close()
+
+	err = tree.open(true)
+	if err != nil {
+		return err
+	}
+
+	err = tree.compact()
+	if err != nil {
+		return err
+	}
+
+	return tree.write_header()
+}
+
+// Read only view of the tree pinned at the current root. Since the
+// file is append only, it stays consistent while the tree is modified.
+func (tree *btree) snapshot() *btree {
+	return &btree{
+		file:    tree.file,
+		offset:  tree.owner().offset,
+		config:  tree.config,
+		root:    tree.root,
+		cmp:     tree.cmp,
+		cmpName: tree.cmpName,
+	}
+}
+
+// Close the file, a no-op on named trees. Watch channels are closed.
+func (tree *btree) Close() error {
+	tree.close_watchers()
+	if tree.parent != nil {
+		return nil
+	}
+
+	for _, child := range tree.trees {
+		child.close_watchers()
+	}
+
+	return tree.file.Close()
+}
+
+func (tree *btree) Stats() Stats {
+	return tree.owner().stats
 }
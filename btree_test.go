@@ -0,0 +1,60 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestOpenComparatorMismatch(t *testing.T) {
+	var n node
+	os.Remove(TEST_FILE)
+
+	RegisterComparator("reverse", func(k1, k2 Key) int {
+		return -bytes.Compare(k1, k2)
+	})
+
+	config := DefaultConfig()
+	config.Comparator = "reverse"
+	tree, err := open_file(TEST_FILE, config)
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+
+	for i := 9; i >= 0; i-- {
+		itm := new(kv)
+		itm.k = Key(fmt.Sprintf("key_%d", i))
+		itm.v = Value(fmt.Sprintf("val_%d", i))
+		n.kvlist = append(n.kvlist, itm)
+	}
+
+	tree.build(n.kvlist)
+	err = tree.write_header()
+	if err != nil {
+		t.Fatalf("Failed header write (%s)", err)
+	}
+	tree.Close()
+
+	tree, err = open_file(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to reopen tree (%s)", err)
+	}
+	if tree.cmpName != "reverse" {
+		t.Errorf("Expected comparator from header, got %s", tree.cmpName)
+	}
+	tree.Close()
+
+	config.Comparator = DEFAULT_COMPARATOR
+	_, err = Open(TEST_FILE, config)
+	if err == nil {
+		t.Fatal("Expected comparator mismatch error")
+	}
+
+	config.Comparator = "unknown"
+	os.Remove(TEST_FILE)
+	_, err = Open(TEST_FILE, config)
+	if err == nil {
+		t.Fatal("Expected error for unregistered comparator")
+	}
+}
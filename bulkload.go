@@ -0,0 +1,300 @@
+package btree
+
+import (
+	"bufio"
+	"container/heap"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+	"unsafe"
+)
+
+// Sorted run spilled to a temp file
+type run struct {
+	id   int
+	file *os.File
+	r    *bufio.Reader
+	cur  *kv
+}
+
+// Advance to the next item, cur is nil when the run is exhausted
+func (r *run) next() error {
+	itm := new(kv)
+	err := itm.Read(r.r)
+	if err == io.EOF {
+		r.cur = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	r.cur = itm
+	return nil
+}
+
+// Min heap of runs ordered by current key, older runs first on ties
+type runHeap struct {
+	runs []*run
+	cmp  func(*Key, *Key) int
+}
+
+func (h runHeap) Len() int { return len(h.runs) }
+
+func (h runHeap) Less(i, j int) bool {
+	c := h.cmp(&h.runs[i].cur.k, &h.runs[j].cur.k)
+	if c == 0 {
+		return h.runs[i].id < h.runs[j].id
+	}
+	return c < 0
+}
+
+func (h runHeap) Swap(i, j int) { h.runs[i], h.runs[j] = h.runs[j], h.runs[i] }
+
+func (h *runHeap) Push(x interface{}) { h.runs = append(h.runs, x.(*run)) }
+
+func (h *runHeap) Pop() interface{} {
+	r := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return r
+}
+
+// Sort buffered kvs and write them out as a run. For duplicate keys
+// only the last one added is kept.
+func (tree *btree) spill(kvs []*kv, id int) (*run, error) {
+	sort.SliceStable(kvs, func(i, j int) bool {
+		return tree.cmp(&kvs[i].k, &kvs[j].k) < 0
+	})
+
+	f, err := ioutil.TempFile(path.Dir(tree.file.Name()), "bulkload")
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(f)
+	for i, itm := range kvs {
+		if i+1 < len(kvs) && tree.cmp(&itm.k, &kvs[i+1].k) == 0 {
+			continue
+		}
+		_, err = w.Write(itm.Bytes())
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		_, err = f.Seek(0, 0)
+	}
+
+	r := &run{id: id, file: f, r: bufio.NewReader(f)}
+	if err != nil {
+		return r, err
+	}
+
+	return r, r.next()
+}
+
+// Merge runs in key order and pass each item to fn. If a key is in
+// several runs, only the item of the latest run is passed.
+func (tree *btree) merge_runs(runs []*run, fn func(*kv) error) error {
+	h := &runHeap{cmp: tree.cmp}
+	for _, r := range runs {
+		if r.cur != nil {
+			h.runs = append(h.runs, r)
+		}
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		r := h.runs[0]
+		itm := r.cur
+		err := r.next()
+		if err != nil {
+			return err
+		}
+
+		if r.cur == nil {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+
+		// A newer run holds the same key, skip this one
+		if h.Len() > 0 && tree.cmp(&itm.k, &h.runs[0].cur.k) == 0 {
+			continue
+		}
+
+		err = fn(itm)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Merge consecutive groups of at most fanin runs into single runs.
+// Runs keep their relative order, so later items still win.
+func (tree *btree) merge_pass(runs []*run, fanin int) ([]*run, error) {
+	var merged []*run
+
+	for len(runs) > 0 {
+		n := fanin
+		if n > len(runs) {
+			n = len(runs)
+		}
+		group := runs[:n]
+
+		f, err := ioutil.TempFile(path.Dir(tree.file.Name()), "bulkload")
+		if err != nil {
+			return append(merged, runs...), err
+		}
+
+		r := &run{id: len(merged), file: f}
+		merged = append(merged, r)
+
+		w := bufio.NewWriter(f)
+		err = tree.merge_runs(group, func(itm *kv) error {
+			_, err := w.Write(itm.Bytes())
+			return err
+		})
+		if err == nil {
+			err = w.Flush()
+		}
+		if err == nil {
+			_, err = f.Seek(0, 0)
+		}
+		if err == nil {
+			r.r = bufio.NewReader(f)
+			err = r.next()
+		}
+
+		for _, r := range group {
+			r.file.Close()
+			os.Remove(r.file.Name())
+		}
+		runs = runs[n:]
+
+		if err != nil {
+			return append(merged, runs...), err
+		}
+	}
+
+	return merged, nil
+}
+
+// Replace the contents of the tree by the items of an unsorted stream,
+// sorted in bounded memory. If a key occurs more than once, the last
+// occurrence wins.
+func (tree *btree) BulkLoad(iter BtreeIter) error {
+	root, err := tree.bulk_build(iter)
+	if err != nil {
+		return err
+	}
+
+	return tree.bulk_commit(root)
+}
+
+// Write the items of iter into new nodes and return their root. The
+// tree is left unchanged until the root is committed.
+func (tree *btree) bulk_build(iter BtreeIter) (*node, error) {
+	var runs []*run
+	var kvs []*kv
+	var size uint32
+	var err error
+
+	limit := tree.config.BulkBufferSize
+	if limit == 0 {
+		limit = DEFAULT_BULK_BUFSIZE
+	}
+
+	defer func() {
+		for _, r := range runs {
+			r.file.Close()
+			os.Remove(r.file.Name())
+		}
+	}()
+
+	eiter, _ := iter.(BtreeExpiryIter)
+	for iter.HasNext() {
+		itm := new(kv)
+		if eiter != nil {
+			var t time.Time
+			itm.k, itm.v, t = eiter.NextExpiry()
+			if !t.IsZero() {
+				itm.expires = t.UnixNano()
+				tree.owner().expiring = true
+			}
+		} else {
+			itm.k, itm.v = iter.Next()
+		}
+		// Runs hold values inline
+		if len(itm.v) > valueLenMask {
+			return nil, ErrValueTooLarge
+		}
+		kvs = append(kvs, itm)
+		// Buffered items also cost their kv struct
+		size += itm.Size() + uint32(unsafe.Sizeof(*itm))
+		if size >= limit {
+			r, err := tree.spill(kvs, len(runs))
+			if r != nil {
+				runs = append(runs, r)
+			}
+			if err != nil {
+				return nil, err
+			}
+			kvs = nil
+			size = 0
+		}
+	}
+
+	if len(kvs) > 0 {
+		r, err := tree.spill(kvs, len(runs))
+		if r != nil {
+			runs = append(runs, r)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fanin := tree.config.BulkMergeFanIn
+	if fanin <= 1 {
+		fanin = DEFAULT_BULK_FANIN
+	}
+
+	for len(runs) > fanin {
+		runs, err = tree.merge_pass(runs, fanin)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	nb := new_node_builder(tree, kvnode)
+	err = tree.merge_runs(runs, nb.add_new)
+	if err != nil {
+		return nil, err
+	}
+
+	return build_root(nb)
+}
+
+// Replace the root with one built by bulk_build and commit it
+func (tree *btree) bulk_commit(root *node) error {
+	err := tree.record_replace(root)
+	if err != nil {
+		return err
+	}
+
+	tree.root = root
+
+	// Individual changes are not known, watchers have to resync
+	tree.resync_watchers()
+	return tree.write_header()
+}
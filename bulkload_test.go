@@ -0,0 +1,75 @@
+package btree
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+type sliceIter struct {
+	kvs []kv
+}
+
+func (it *sliceIter) HasNext() bool {
+	return len(it.kvs) > 0
+}
+
+func (it *sliceIter) Next() (Key, Value) {
+	itm := it.kvs[0]
+	it.kvs = it.kvs[1:]
+	return itm.k, itm.v
+}
+
+func TestBulkLoad(t *testing.T) {
+	N := 5000
+	tree := initTree()
+	tree.cmp = func(k1, k2 *Key) int {
+		return compareKeyIds(*k1, *k2)
+	}
+	tree.config.BulkBufferSize = 16384
+	// Spills about 50 runs, merged in several passes
+	tree.config.BulkMergeFanIn = 4
+
+	iter := new(sliceIter)
+	for _, i := range rand.Perm(N) {
+		iter.kvs = append(iter.kvs, kv{k: make_key(i), v: make_value(0)})
+	}
+	// Later duplicates replace earlier ones
+	for _, i := range rand.Perm(N) {
+		iter.kvs = append(iter.kvs, kv{k: make_key(i), v: make_value(i)})
+	}
+
+	err := tree.BulkLoad(iter)
+	if err != nil {
+		t.Fatalf("Bulk load failed (%s)", err)
+	}
+
+	received := []kv{}
+	qreq := &QueryRequest{
+		Keys: []*Key{nil, nil},
+		Callback: func(itm kv) {
+			received = append(received, itm)
+		},
+		Range: true,
+	}
+
+	err = tree.query(qreq)
+	if err != nil {
+		t.Fatalf("query returned non-nil error (%s)", err)
+	}
+
+	if len(received) != N {
+		t.Fatalf("Expected %d items, found %d", N, len(received))
+	}
+
+	for i := 0; i < N; i++ {
+		if !equals(received[i], kv{k: make_key(i), v: make_value(i)}) {
+			t.Fatalf("Unexpected item %s/%s", string(received[i].k), string(received[i].v))
+		}
+	}
+
+	tmpfiles, _ := filepath.Glob("bulkload[0-9]*")
+	if len(tmpfiles) != 0 {
+		t.Errorf("Temp files left behind %v", tmpfiles)
+	}
+}
@@ -0,0 +1,122 @@
+package btree
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Names starting with this are reserved for trees maintained internally
+const RESERVED_PREFIX = "_"
+
+// Tree that owns the file, named trees use the offset of their parent
+func (tree *btree) owner() *btree {
+	if tree.parent != nil {
+		return tree.parent
+	}
+
+	return tree
+}
+
+// Open a named tree stored in the same file, creating it if needed.
+// Each named tree has its own comparator, an empty name uses the
+// recorded one, or the default for a new tree. Changes to all trees
+// of the file are committed together by a single Flush.
+func (tree *btree) Tree(name, comparator string) (Btree, error) {
+	switch {
+	case name == "":
+		return nil, errors.New("Tree name must not be empty")
+	case strings.HasPrefix(name, RESERVED_PREFIX):
+		return nil, errors.New("Tree name " + name + " is reserved")
+	}
+
+	child, err := tree.named(name, comparator)
+	if err != nil {
+		return nil, err
+	}
+
+	return child, nil
+}
+
+func (tree *btree) named(name, comparator string) (*btree, error) {
+	var err error
+	o := tree.owner()
+
+	child, ok := o.trees[name]
+	switch {
+	case !ok:
+		child = &btree{
+			file:    o.file,
+			config:  o.config,
+			parent:  o,
+			name:    name,
+			cmpName: comparator,
+		}
+		if comparator == "" {
+			child.cmpName = DEFAULT_COMPARATOR
+		}
+	case child.cmpName == UNREGISTERED_COMPARATOR:
+		if comparator != "" {
+			child.cmp, err = lookupComparator(comparator)
+			if err != nil {
+				return nil, err
+			}
+			child.cmpName = comparator
+		} else if child.cmp == nil {
+			return nil, errors.New("Tree " + name + " was written with an unregistered comparator, pass its name")
+		}
+	case comparator != "" && comparator != child.cmpName:
+		return nil, errors.New("Comparator mismatch: tree " + name + " uses " +
+			child.cmpName + ", requested " + comparator)
+	}
+
+	// Orderings set with SetComparator are kept
+	if child.cmpName != UNREGISTERED_COMPARATOR {
+		child.cmp, err = lookupComparator(child.cmpName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Refuse a tree that would not fit in the header of the next commit
+	if !ok {
+		h := header{features: FEATURE_CATALOG, cmp: o.cmpName}
+		for n, t := range o.trees {
+			h.trees = append(h.trees, catalogEntry{name: n, cmp: t.cmpName})
+		}
+		h.trees = append(h.trees, catalogEntry{name: name, cmp: child.cmpName})
+
+		err = h.check()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !ok {
+		if o.trees == nil {
+			o.trees = make(map[string]*btree)
+		}
+		o.trees[name] = child
+	}
+
+	return child, nil
+}
+
+// Names of the named trees in the file, sorted. Internal trees are
+// included only if internal is set.
+func (tree *btree) tree_names(internal bool) []string {
+	var names []string
+	for name := range tree.owner().trees {
+		if internal || !strings.HasPrefix(name, RESERVED_PREFIX) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Names of the named trees in the file, sorted
+func (tree *btree) TreeNames() []string {
+	return tree.tree_names(false)
+}
@@ -0,0 +1,160 @@
+package btree
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func scanKeys(t *testing.T, tree *btree) []string {
+	var keys []string
+	err := tree.Scan(nil, nil, func(k Key, v Value) bool {
+		keys = append(keys, string(k))
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Scan failed (%s)", err)
+	}
+
+	return keys
+}
+
+func TestNamedTrees(t *testing.T) {
+	os.Remove(TEST_FILE)
+	defer os.Remove(TEST_FILE)
+
+	RegisterComparator("reverse", func(k1, k2 Key) int {
+		return -bytes.Compare(k1, k2)
+	})
+
+	tree, err := open_file(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+
+	users, err := tree.Tree("users", "")
+	if err != nil {
+		t.Fatalf("Failed to open named tree (%s)", err)
+	}
+	index, err := tree.Tree("index", "reverse")
+	if err != nil {
+		t.Fatalf("Failed to open named tree (%s)", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		tree.Insert(make_key(i), make_value(i))
+		users.Insert(make_key(i+10), make_value(i))
+		index.Insert(make_key(i+20), make_value(i))
+	}
+
+	// A single flush commits all trees together
+	err = users.Flush()
+	if err != nil {
+		t.Fatalf("Flush failed (%s)", err)
+	}
+	versions, _ := tree.Versions()
+	if len(versions) != 1 {
+		t.Errorf("Expected a single committed version, found %d", len(versions))
+	}
+
+	_, err = tree.Tree("index", DEFAULT_COMPARATOR)
+	if err == nil {
+		t.Error("Expected comparator mismatch for named tree")
+	}
+	_, err = tree.Tree("", "")
+	if err == nil {
+		t.Error("Expected error for empty tree name")
+	}
+	tree.Close()
+
+	check := func(tree *btree) {
+		users, _ := tree.named("users", "")
+		index, _ := tree.named("index", "")
+		if index.cmpName != "reverse" {
+			t.Errorf("Expected recorded comparator, got %s", index.cmpName)
+		}
+
+		expected := map[*btree][]string{
+			tree:  []string{"key_0", "key_1", "key_2"},
+			users: []string{"key_10", "key_11", "key_12"},
+			index: []string{"key_22", "key_21", "key_20"},
+		}
+		for tr, keys := range expected {
+			if found := scanKeys(t, tr); !reflect.DeepEqual(found, keys) {
+				t.Errorf("Expected %v, found %v", keys, found)
+			}
+
+			report, err := tr.Verify(VerifyOptions{Checksums: true})
+			if err != nil || !report.Ok() {
+				t.Errorf("Verify failed (%v) %v", err, report)
+			}
+		}
+
+		if !reflect.DeepEqual(tree.TreeNames(), []string{"index", "users"}) {
+			t.Errorf("Unexpected tree names %v", tree.TreeNames())
+		}
+	}
+
+	tree, err = open_file(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to reopen tree (%s)", err)
+	}
+	check(tree)
+
+	index, _ = tree.Tree("index", "")
+	index.Remove(make_key(21))
+	index.Insert(make_key(21), make_value(21))
+	err = index.Compact()
+	if err != nil {
+		t.Fatalf("Compact failed (%s)", err)
+	}
+	check(tree)
+	tree.Close()
+
+	tree, err = open_file(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to reopen tree (%s)", err)
+	}
+	check(tree)
+	tree.Close()
+}
+
+func TestCatalogLimits(t *testing.T) {
+	os.Remove(TEST_FILE)
+	defer os.Remove(TEST_FILE)
+
+	tree, err := open_file(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+
+	created := 0
+	for ; created < 100; created++ {
+		name := string(bytes.Repeat([]byte{'a' + byte(created%26)}, 1000)) + string(make_key(created))
+		_, err = tree.Tree(name, "")
+		if err != nil {
+			break
+		}
+	}
+
+	if err != ErrHeaderTooLarge || created == 0 {
+		t.Fatalf("Expected header size error after some trees, got %v after %d", err, created)
+	}
+
+	err = tree.Flush()
+	if err != nil {
+		t.Fatalf("Flush failed (%s)", err)
+	}
+	tree.Close()
+
+	tree, err = open_file(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to reopen tree (%s)", err)
+	}
+	defer tree.Close()
+
+	if len(tree.TreeNames()) != created {
+		t.Errorf("Expected %d named trees, found %d", created, len(tree.TreeNames()))
+	}
+}
@@ -0,0 +1,262 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// Name of the by-sequence index of the default tree, named trees
+// use SEQ_TREE + "/" + name
+const SEQ_TREE = RESERVED_PREFIX + "seq"
+
+var ErrChangesNotTracked = errors.New("Changes are not tracked for this tree")
+
+// Update recorded in the by-sequence index
+type Change struct {
+	Seq     uint64
+	Key     Key
+	Deleted bool
+}
+
+// Sequence numbers are stored big endian, so that byte order is
+// sequence order
+func seqKey(seq uint64) Key {
+	k := make(Key, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// Entry value is the operation followed by the key
+func decodeChange(itm *kv) Change {
+	return Change{
+		Seq:     binary.BigEndian.Uint64(itm.k),
+		Key:     Key(itm.v[1:]),
+		Deleted: itm.v[0] == OP_DELETE,
+	}
+}
+
+// Return the by-sequence index of the tree, or nil if changes are not
+// tracked. The index is created on first use if TrackChanges is set.
+func (tree *btree) seq_tree() (*btree, error) {
+	if tree.byseq != nil {
+		return tree.byseq, nil
+	}
+
+	// Internal trees are not tracked themselves
+	if strings.HasPrefix(tree.name, RESERVED_PREFIX) {
+		return nil, nil
+	}
+
+	name := SEQ_TREE
+	if tree.parent != nil {
+		name += "/" + tree.name
+	}
+
+	if _, ok := tree.owner().trees[name]; !ok && !tree.config.TrackChanges {
+		return nil, nil
+	}
+
+	s, err := tree.named(name, DEFAULT_COMPARATOR)
+	if err != nil {
+		return nil, err
+	}
+
+	last, err := s.last()
+	if err != nil {
+		return nil, err
+	}
+
+	// Numbers discarded with a truncating rollback are not reused
+	tree.seq = tree.owner().seqs[tree.name]
+	if last != nil && binary.BigEndian.Uint64(last.k) > tree.seq {
+		tree.seq = binary.BigEndian.Uint64(last.k)
+	}
+
+	tree.byseq = s
+	return s, nil
+}
+
+// Highest sequence number assigned by each tree of the file, those
+// recorded in the header included
+func (tree *btree) seq_marks() map[string]uint64 {
+	marks := make(map[string]uint64)
+	for name, seq := range tree.seqs {
+		marks[name] = seq
+	}
+
+	for _, t := range tree.all_trees() {
+		if t.seq > marks[t.name] {
+			marks[t.name] = t.seq
+		}
+	}
+
+	return marks
+}
+
+// Last item in key order, nil for an empty tree
+func (tree *btree) last() (*kv, error) {
+	var err error
+
+	n := tree.root
+	if n == nil {
+		return nil, nil
+	}
+
+	for n.ntype == kpnode {
+		n, err = tree.readNode(v2p(n.kvlist[len(n.kvlist)-1].v))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return n.kvlist[len(n.kvlist)-1], nil
+}
+
+// Add the applied operations of a modify request to the by-sequence
+// index
+func (tree *btree) record_changes(rq *ModifyRequest) error {
+	s, err := tree.seq_tree()
+	if s == nil || err != nil {
+		return err
+	}
+
+	srq := &ModifyRequest{}
+	for _, op := range rq.ops {
+		if !op.applied {
+			continue
+		}
+
+		v := append(Value{OP_INSERT}, op.itm.k...)
+		if op.deletes() {
+			v[0] = OP_DELETE
+		}
+		srq.ops = append(srq.ops, Operation{itm: kv{k: seqKey(op.seq), v: v}, op: OP_INSERT})
+	}
+
+	return s.modify(srq)
+}
+
+// Record the replacement of all items by the tree at root, as done by
+// bulk loads. Keys of root are recorded as inserts and keys that are
+// gone as deletes, both in key order.
+func (tree *btree) record_replace(root *node) error {
+	s, err := tree.seq_tree()
+	if s == nil || err != nil {
+		return err
+	}
+
+	loaded := tree.snapshot()
+	loaded.root = root
+	it := &treeIter{snap: loaded}
+
+	rq := &ModifyRequest{}
+	record := func(k Key, op int) {
+		tree.seq++
+		rq.ops = append(rq.ops, Operation{itm: kv{k: k}, op: op, applied: true, seq: tree.seq})
+		if len(rq.ops) == iterBatch {
+			err = tree.record_changes(rq)
+			rq.ops = nil
+		}
+	}
+
+	var old *QueryRequest
+	old = &QueryRequest{
+		Keys: []*Key{nil, nil},
+		Callback: func(itm kv) {
+			found := false
+			for err == nil && it.HasNext() {
+				c := tree.cmp(&it.items[0].k, &itm.k)
+				if c > 0 {
+					break
+				}
+				found = found || c == 0
+				k, _ := it.Next()
+				record(k, OP_INSERT)
+			}
+
+			if !found {
+				record(itm.k, OP_DELETE)
+			}
+			if err != nil {
+				old.stop = true
+			}
+		},
+		Range: true,
+	}
+
+	qerr := tree.query(old)
+	for err == nil && qerr == nil && it.HasNext() {
+		k, _ := it.Next()
+		record(k, OP_INSERT)
+	}
+
+	switch {
+	case qerr != nil:
+		return qerr
+	case err != nil:
+		return err
+	case it.err != nil:
+		return it.err
+	}
+
+	return tree.record_changes(rq)
+}
+
+// Return a filter that accepts only the latest change of each key, used
+// to drop superseded entries from the index on compaction
+func (tree *btree) latest_changes() (func(*kv) bool, error) {
+	latest := make(map[string]uint64)
+
+	rq := &QueryRequest{
+		Keys: []*Key{nil, nil},
+		Callback: func(itm kv) {
+			c := decodeChange(&itm)
+			latest[string(c.Key)] = c.Seq
+		},
+		Range: true,
+	}
+
+	err := tree.query(rq)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(itm *kv) bool {
+		c := decodeChange(itm)
+		return latest[string(c.Key)] == c.Seq
+	}, nil
+}
+
+// Call fn for keys changed after sequence since, in the order the
+// changes were made, until it returns false. Removing a missing key is
+// not a change. Compaction keeps only the latest change of each key.
+func (tree *btree) Changes(since uint64, fn func(Change) bool) error {
+	s, err := tree.seq_tree()
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return ErrChangesNotTracked
+	}
+
+	start := seqKey(since + 1)
+	var rq *QueryRequest
+	rq = &QueryRequest{
+		Keys: []*Key{&start, nil},
+		Callback: func(itm kv) {
+			if !rq.stop && !fn(decodeChange(&itm)) {
+				rq.stop = true
+			}
+		},
+		Range: true,
+	}
+
+	return s.query(rq)
+}
+
+// Last sequence number assigned, 0 if changes are not tracked
+func (tree *btree) LastSeq() (uint64, error) {
+	_, err := tree.seq_tree()
+	return tree.seq, err
+}
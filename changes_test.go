@@ -0,0 +1,171 @@
+package btree
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestChanges(t *testing.T) {
+	os.Remove(TEST_FILE)
+	defer os.Remove(TEST_FILE)
+
+	tree, err := open_file(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+
+	tree.Insert(make_key(1), make_value(1))
+	err = tree.Changes(0, func(c Change) bool { return true })
+	if err != ErrChangesNotTracked {
+		t.Errorf("Expected untracked changes error (%v)", err)
+	}
+	tree.Flush()
+	tree.Close()
+
+	config := DefaultConfig()
+	config.TrackChanges = true
+	tree, err = open_file(TEST_FILE, config)
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		tree.Insert(make_key(i), make_value(i))
+	}
+	tree.Remove(make_key(2))
+	tree.Insert(make_key(0), make_value(10))
+	tree.Flush()
+	tree.Close()
+
+	changes := func(tree *btree, since uint64) []Change {
+		var found []Change
+		err := tree.Changes(since, func(c Change) bool {
+			found = append(found, c)
+			return true
+		})
+		if err != nil {
+			t.Fatalf("Changes failed (%s)", err)
+		}
+		return found
+	}
+
+	// Tracking continues once the index exists
+	tree, err = open_file(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to reopen tree (%s)", err)
+	}
+	defer tree.Close()
+
+	expected := []Change{
+		{Seq: 6, Key: make_key(2), Deleted: true},
+		{Seq: 7, Key: make_key(0)},
+	}
+	if found := changes(tree, 5); !reflect.DeepEqual(found, expected) {
+		t.Errorf("Expected %v, found %v", expected, found)
+	}
+
+	tree.Insert(make_key(5), make_value(5))
+	if seq, _ := tree.LastSeq(); seq != 8 {
+		t.Errorf("Expected last sequence 8, found %d", seq)
+	}
+
+	err = tree.Compact()
+	if err != nil {
+		t.Fatalf("Compact failed (%s)", err)
+	}
+
+	// Superseded changes are dropped by compaction
+	var seqs []uint64
+	for _, c := range changes(tree, 0) {
+		seqs = append(seqs, c.Seq)
+	}
+	if !reflect.DeepEqual(seqs, []uint64{2, 4, 5, 6, 7, 8}) {
+		t.Errorf("Unexpected sequences after compaction %v", seqs)
+	}
+
+	if names := tree.TreeNames(); len(names) != 0 {
+		t.Errorf("Expected internal trees to be hidden, found %v", names)
+	}
+	_, err = tree.Tree(SEQ_TREE, "")
+	if err == nil {
+		t.Error("Expected error for reserved tree name")
+	}
+}
+
+func TestChangesMissingDelete(t *testing.T) {
+	os.Remove(TEST_FILE)
+	defer os.Remove(TEST_FILE)
+
+	config := DefaultConfig()
+	config.TrackChanges = true
+	tree, err := Open(TEST_FILE, config)
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+	defer tree.Close()
+
+	tree.Insert(make_key(1), make_value(1))
+	tree.Remove(make_key(2))
+	tree.Remove(make_key(1))
+
+	var found []Change
+	tree.Changes(0, func(c Change) bool {
+		found = append(found, c)
+		return true
+	})
+
+	expected := []Change{
+		{Seq: 1, Key: make_key(1)},
+		{Seq: 2, Key: make_key(1), Deleted: true},
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("Expected %v, found %v", expected, found)
+	}
+}
+
+func TestChangesBulkLoad(t *testing.T) {
+	os.Remove(TEST_FILE)
+	defer os.Remove(TEST_FILE)
+
+	config := DefaultConfig()
+	config.TrackChanges = true
+	tree, err := Open(TEST_FILE, config)
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+	defer tree.Close()
+
+	for i := 0; i < 5; i++ {
+		tree.Insert(make_key(i), make_value(i))
+	}
+
+	iter := new(sliceIter)
+	for i := 7; i >= 3; i-- {
+		iter.kvs = append(iter.kvs, kv{k: make_key(i), v: make_value(i)})
+	}
+	err = tree.BulkLoad(iter)
+	if err != nil {
+		t.Fatalf("Bulk load failed (%s)", err)
+	}
+
+	var found []Change
+	tree.Changes(5, func(c Change) bool {
+		found = append(found, c)
+		return true
+	})
+
+	expected := []Change{
+		{Seq: 6, Key: make_key(0), Deleted: true},
+		{Seq: 7, Key: make_key(1), Deleted: true},
+		{Seq: 8, Key: make_key(2), Deleted: true},
+		{Seq: 9, Key: make_key(3)},
+		{Seq: 10, Key: make_key(4)},
+		{Seq: 11, Key: make_key(5)},
+		{Seq: 12, Key: make_key(6)},
+		{Seq: 13, Key: make_key(7)},
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("Expected %v, found %v", expected, found)
+	}
+}
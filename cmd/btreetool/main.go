@@ -0,0 +1,369 @@
+// Command btreetool inspects and modifies btree files.
+//
+// Usage:
+//
+//	btreetool [-comparator name] [-flate] [-track] <command> [flags] <file> [args]
+//
+// Commands:
+//
+//	info                              header, depth and node counts
+//	get <key>                         print the value of a key
+//	put <key> <value>                 insert or update a key
+//	del <key>                         remove a key
+//	scan [-start k] [-end k] [-limit n]
+//	                                  print items in key order
+//	dump [-format json|binary]        write all items to stdout
+//	load                              replace contents from a dump on stdin
+//	compact                           rewrite live data into a new file
+//	verify [-checksums]               check structural invariants
+//	versions                          list committed versions
+//	structure [-format dot|json] [-depth n] [-sample n]
+//	                                  write the node layout
+//	changes [-since n]                list changed keys in update order
+//	rollback [-truncate] <version>    revert to a committed version
+package main
+
+import (
+	"compress/flate"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	btree "github.com/t3rm1n4l/go-btree"
+)
+
+type command struct {
+	// Optional setup of command flags
+	flags func(fs *flag.FlagSet)
+	run   func(tree btree.Btree, args []string) error
+	// Fails on a missing file instead of creating it
+	readonly bool
+}
+
+var commands = map[string]command{
+	"info":      {nil, info, true},
+	"get":       {nil, get, true},
+	"put":       {nil, put, false},
+	"del":       {nil, del, false},
+	"scan":      {scanFlags, scan, true},
+	"dump":      {dumpFlags, dump, true},
+	"load":      {nil, load, false},
+	"compact":   {nil, compact, false},
+	"verify":    {verifyFlags, verify, true},
+	"versions":  {nil, versions, true},
+	"structure": {structureFlags, structure, true},
+	"changes":   {changesFlags, changes, true},
+	"rollback":  {rollbackFlags, rollback, false},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: btreetool [-comparator name] [-flate] [-track] <command> [flags] <file> [args]")
+	fmt.Fprintln(os.Stderr, "commands: info get put del scan dump load compact verify versions structure changes rollback")
+	os.Exit(2)
+}
+
+func main() {
+	comparator := flag.String("comparator", "", "registered comparator name")
+	compress := flag.Bool("flate", false, "compress nodes with flate")
+	track := flag.Bool("track", false, "maintain a by-sequence index of updates")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+	}
+
+	name := flag.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+	}
+
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	fs.Parse(flag.Args()[1:])
+	if fs.NArg() < 1 {
+		usage()
+	}
+
+	config := btree.DefaultConfig()
+	config.Comparator = *comparator
+	config.TrackChanges = *track
+	if *compress {
+		config.Codec = btree.FlateCodec{Level: flate.DefaultCompression}
+	}
+
+	// Open creates missing files
+	if cmd.readonly {
+		_, err := os.Stat(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "btreetool:", err)
+			os.Exit(1)
+		}
+	}
+
+	tree, err := btree.Open(fs.Arg(0), config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "btreetool:", err)
+		os.Exit(1)
+	}
+
+	err = cmd.run(tree, fs.Args()[1:])
+	cerr := tree.Close()
+	if err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "btreetool:", err)
+		os.Exit(1)
+	}
+}
+
+func nargs(args []string, n int) error {
+	if len(args) != n {
+		return fmt.Errorf("expected %d arguments, got %d", n, len(args))
+	}
+
+	return nil
+}
+
+func info(tree btree.Btree, args []string) error {
+	inf, err := tree.Info()
+	if err != nil {
+		return err
+	}
+
+	stats := tree.Stats()
+	fmt.Printf("generation:  %x\n", inf.Version.Generation)
+	fmt.Printf("version:     %d\n", inf.Version.Offset)
+	fmt.Printf("format:      %d\n", inf.Format)
+	fmt.Printf("features:    %#x\n", inf.Features)
+	fmt.Printf("comparator:  %s\n", inf.Comparator)
+	fmt.Printf("file size:   %d\n", inf.FileSize)
+	fmt.Printf("depth:       %d\n", inf.Depth)
+	fmt.Printf("kp nodes:    %d\n", inf.KPNodes)
+	fmt.Printf("kv nodes:    %d\n", inf.KVNodes)
+	fmt.Printf("items:       %d\n", inf.Items)
+	fmt.Printf("expired:     %d\n", inf.Expired)
+	fmt.Printf("tombstones:  %d\n", inf.Tombstones)
+	fmt.Printf("compression: %.2f\n", stats.CompressionRatio())
+
+	return nil
+}
+
+func get(tree btree.Btree, args []string) error {
+	err := nargs(args, 1)
+	if err != nil {
+		return err
+	}
+
+	v, err := tree.Get(btree.Key(args[0]))
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(append(v, '\n'))
+	return err
+}
+
+func put(tree btree.Btree, args []string) error {
+	err := nargs(args, 2)
+	if err != nil {
+		return err
+	}
+
+	err = tree.Insert(btree.Key(args[0]), btree.Value(args[1]))
+	if err != nil {
+		return err
+	}
+
+	return tree.Flush()
+}
+
+func del(tree btree.Btree, args []string) error {
+	err := nargs(args, 1)
+	if err != nil {
+		return err
+	}
+
+	err = tree.Remove(btree.Key(args[0]))
+	if err != nil {
+		return err
+	}
+
+	return tree.Flush()
+}
+
+var (
+	scanStart  *string
+	scanEnd    *string
+	scanLimit  *int
+	dumpFormat *string
+	checksums  *bool
+
+	structFormat *string
+	structDepth  *int
+	structSample *int
+
+	changesSince *uint64
+	truncate     *bool
+)
+
+func scanFlags(fs *flag.FlagSet) {
+	scanStart = fs.String("start", "", "first key of the range")
+	scanEnd = fs.String("end", "", "last key of the range")
+	scanLimit = fs.Int("limit", 0, "maximum number of items, 0 for no limit")
+}
+
+func scan(tree btree.Btree, args []string) error {
+	var start, end btree.Key
+	if *scanStart != "" {
+		start = btree.Key(*scanStart)
+	}
+	if *scanEnd != "" {
+		end = btree.Key(*scanEnd)
+	}
+
+	count := 0
+	return tree.Scan(start, end, func(k btree.Key, v btree.Value) bool {
+		fmt.Printf("%s\t%s\n", k, v)
+		count++
+		return *scanLimit == 0 || count < *scanLimit
+	})
+}
+
+func format(name string) (int, error) {
+	switch name {
+	case "json":
+		return btree.DUMP_JSON, nil
+	case "binary":
+		return btree.DUMP_BINARY, nil
+	case "dot":
+		return btree.DUMP_DOT, nil
+	}
+
+	return 0, fmt.Errorf("unknown dump format %q", name)
+}
+
+func dumpFlags(fs *flag.FlagSet) {
+	dumpFormat = fs.String("format", "json", "dump format, json or binary")
+}
+
+func dump(tree btree.Btree, args []string) error {
+	f, err := format(*dumpFormat)
+	if err != nil {
+		return err
+	}
+
+	return tree.Dump(os.Stdout, f)
+}
+
+func load(tree btree.Btree, args []string) error {
+	return tree.Restore(os.Stdin)
+}
+
+func compact(tree btree.Btree, args []string) error {
+	return tree.Compact()
+}
+
+func verifyFlags(fs *flag.FlagSet) {
+	checksums = fs.Bool("checksums", false, "verify checksums of every reachable node")
+}
+
+func verify(tree btree.Btree, args []string) error {
+	report, err := tree.Verify(btree.VerifyOptions{Checksums: *checksums})
+	if err != nil {
+		return err
+	}
+
+	for _, v := range report.Violations {
+		fmt.Println(v)
+	}
+
+	if !report.Ok() {
+		return fmt.Errorf("%d violations found", len(report.Violations))
+	}
+
+	fmt.Printf("ok: version %d, depth %d, %d nodes, %d items\n",
+		report.Version.Offset, report.Depth, report.Nodes, report.Items)
+	if report.Unchecked > 0 {
+		fmt.Printf("%d nodes have no checksum\n", report.Unchecked)
+	}
+	return nil
+}
+
+func versions(tree btree.Btree, args []string) error {
+	vers, err := tree.Versions()
+	if err != nil {
+		return err
+	}
+
+	for _, v := range vers {
+		fmt.Println(v.Offset)
+	}
+
+	return nil
+}
+
+func structureFlags(fs *flag.FlagSet) {
+	structFormat = fs.String("format", "dot", "output format, dot or json")
+	structDepth = fs.Int("depth", 0, "levels to descend, 0 for no limit")
+	structSample = fs.Int("sample", 0, "children shown per node, 0 for no limit")
+}
+
+func structure(tree btree.Btree, args []string) error {
+	f, err := format(*structFormat)
+	if err != nil {
+		return err
+	}
+
+	opts := btree.StructureOptions{
+		MaxDepth:    *structDepth,
+		MaxChildren: *structSample,
+	}
+
+	return tree.DumpStructure(os.Stdout, f, opts)
+}
+
+func changesFlags(fs *flag.FlagSet) {
+	changesSince = fs.Uint64("since", 0, "list changes after this sequence number")
+}
+
+func changes(tree btree.Btree, args []string) error {
+	return tree.Changes(*changesSince, func(c btree.Change) bool {
+		op := "put"
+		if c.Deleted {
+			op = "del"
+		}
+		fmt.Printf("%d\t%s\t%s\n", c.Seq, op, c.Key)
+		return true
+	})
+}
+
+func rollbackFlags(fs *flag.FlagSet) {
+	truncate = fs.Bool("truncate", false, "cut the file after the version instead of keeping history")
+}
+
+func rollback(tree btree.Btree, args []string) error {
+	err := nargs(args, 1)
+	if err != nil {
+		return err
+	}
+
+	v, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	// Versions are listed by offset within the current generation
+	inf, err := tree.Info()
+	if err != nil {
+		return err
+	}
+
+	return tree.RollbackTo(btree.Version{Generation: inf.Version.Generation, Offset: v}, *truncate)
+}
@@ -0,0 +1,55 @@
+package btree
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+)
+
+// Node payload compression codec. The name is recorded in the file
+// header, so it must always refer to the same encoding.
+type Codec interface {
+	Name() string
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+// Codec backed by compress/flate, Level 0 uses flate.DefaultCompression
+type FlateCodec struct {
+	Level int
+}
+
+func (c FlateCodec) Name() string {
+	return "flate"
+}
+
+func (c FlateCodec) Compress(src []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+
+	buf := new(bytes.Buffer)
+	w, err := flate.NewWriter(buf, level)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(src)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c FlateCodec) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,43 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+const DEFAULT_COMPARATOR = "bytes"
+
+// Recorded for orderings set with SetComparator, which have no name.
+// Such files only open with an explicit Config.Comparator.
+const UNREGISTERED_COMPARATOR = RESERVED_PREFIX + "unregistered"
+
+var (
+	comparatorsLock sync.RWMutex
+	comparators     = map[string]func(*Key, *Key) int{
+		DEFAULT_COMPARATOR: func(k1, k2 *Key) int {
+			return bytes.Compare(*k1, *k2)
+		},
+	}
+)
+
+// Register a named key ordering. The name is recorded in the file
+// header, so it must always refer to the same ordering.
+func RegisterComparator(name string, cmp func(Key, Key) int) {
+	comparatorsLock.Lock()
+	defer comparatorsLock.Unlock()
+	comparators[name] = func(k1, k2 *Key) int {
+		return cmp(*k1, *k2)
+	}
+}
+
+func lookupComparator(name string) (func(*Key, *Key) int, error) {
+	comparatorsLock.RLock()
+	defer comparatorsLock.RUnlock()
+	cmp, ok := comparators[name]
+	if !ok {
+		return nil, errors.New("Comparator not registered: " + name)
+	}
+
+	return cmp, nil
+}
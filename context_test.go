@@ -0,0 +1,100 @@
+package btree
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestContextCancel(t *testing.T) {
+	os.Remove(TEST_FILE)
+	defer os.Remove(TEST_FILE)
+
+	config := DefaultConfig()
+	config.kvChunkSize = KV_CHUNKSIZE
+	config.kpChunkSize = KP_CHUNKSIZE
+	tree, err := Open(TEST_FILE, config)
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+	defer tree.Close()
+
+	for i := 0; i < 1000; i++ {
+		tree.Insert(make_key(i), make_value(i))
+	}
+	tree.Flush()
+	before, _ := tree.Info()
+	goroutines := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	count := 0
+	err = tree.ScanContext(ctx, nil, nil, func(k Key, v Value) bool {
+		count++
+		if count == 10 {
+			cancel()
+		}
+		return true
+	})
+	if err != context.Canceled || count >= 1000 {
+		t.Errorf("Expected scan to be canceled after %d items (%v)", count, err)
+	}
+
+	_, err = tree.GetContext(ctx, make_key(1))
+	if err != context.Canceled {
+		t.Errorf("Expected canceled get (%v)", err)
+	}
+
+	one := binary.LittleEndian.AppendUint64(nil, 1)
+	err = tree.MergeContext(ctx, MERGE_ADD, MergeOperand{Key: make_key(1), Operand: one})
+	if err != context.Canceled {
+		t.Errorf("Expected canceled merge (%v)", err)
+	}
+	if v, _ := tree.Get(make_key(1)); string(v) != string(make_value(1)) {
+		t.Errorf("Expected value unchanged by canceled merge, found %s", v)
+	}
+
+	err = tree.InsertContext(ctx, make_key(1), make_value(2))
+	if err != context.Canceled {
+		t.Errorf("Expected canceled insert (%v)", err)
+	}
+
+	err = tree.RemoveContext(ctx, make_key(1))
+	if err != context.Canceled {
+		t.Errorf("Expected canceled remove (%v)", err)
+	}
+
+	ok, err := tree.PutIfAbsentContext(ctx, make_key(5000), make_value(5000))
+	if err != context.Canceled || ok {
+		t.Errorf("Expected canceled put if absent (%v)", err)
+	}
+
+	err = tree.FlushContext(ctx)
+	if err != context.Canceled {
+		t.Errorf("Expected canceled flush (%v)", err)
+	}
+	if v, _ := tree.Get(make_key(1)); string(v) != string(make_value(1)) {
+		t.Errorf("Expected value unchanged by canceled writes, found %s", v)
+	}
+
+	err = tree.CompactContext(ctx)
+	if err != context.Canceled {
+		t.Errorf("Expected canceled compaction (%v)", err)
+	}
+
+	tmp, _ := filepath.Glob("compact*")
+	if len(tmp) != 0 {
+		t.Errorf("Expected temp files to be removed, found %v", tmp)
+	}
+
+	after, err := tree.Info()
+	if err != nil || after.Version != before.Version || after.Items != before.Items {
+		t.Errorf("Expected tree unchanged by canceled compaction (%v)", err)
+	}
+
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("Expected no leaked goroutines, found %d more", n-goroutines)
+	}
+}
@@ -0,0 +1,212 @@
+package btree
+
+import (
+	"bytes"
+)
+
+// Diff entry types
+const (
+	DIFF_ADDED = iota
+	DIFF_REMOVED
+	DIFF_CHANGED
+)
+
+// Key that differs between two versions
+type DiffEntry struct {
+	Type int
+	Key  Key
+	// Value in the old and new version, nil where the key is absent
+	Old Value
+	New Value
+}
+
+// Position in one version. Entries of a frame at level 0 are items,
+// above that they point to nodes one level down.
+type diffFrame struct {
+	n     *node
+	i     int
+	level int
+}
+
+type diffCursor struct {
+	tree  *btree
+	stack []*diffFrame
+}
+
+// Root of this tree in the header of a version
+func (tree *btree) version_root(version Version) (int64, error) {
+	h, err := tree.owner().find_version(version)
+	if err != nil {
+		return 0, err
+	}
+
+	if tree.parent == nil {
+		return h.rootptr, nil
+	}
+
+	for _, e := range h.trees {
+		if e.name == tree.name {
+			return e.rootptr, nil
+		}
+	}
+
+	return EMPTY_ROOT, nil
+}
+
+func (tree *btree) diff_cursor(rootptr int64) (*diffCursor, error) {
+	c := &diffCursor{tree: tree}
+	if rootptr == EMPTY_ROOT {
+		return c, nil
+	}
+
+	n, err := tree.readNode(rootptr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Height of the tree along the leftmost path
+	level := 0
+	for x := n; x.ntype == kpnode; level++ {
+		x, err = tree.readNode(v2p(x.kvlist[0].v))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.stack = append(c.stack, &diffFrame{n: n, level: level})
+	return c, nil
+}
+
+// Current entry and its level, nil at the end
+func (c *diffCursor) head() (*kv, int) {
+	for len(c.stack) > 0 {
+		f := c.stack[len(c.stack)-1]
+		if f.i < len(f.n.kvlist) {
+			return f.n.kvlist[f.i], f.level
+		}
+		c.stack = c.stack[:len(c.stack)-1]
+	}
+
+	return nil, 0
+}
+
+func (c *diffCursor) next() {
+	c.stack[len(c.stack)-1].i++
+}
+
+// Replace the current pointer with the entries of its node
+func (c *diffCursor) expand() error {
+	itm, level := c.head()
+	c.next()
+
+	n, err := c.tree.readNode(v2p(itm.v))
+	if err != nil {
+		return err
+	}
+
+	c.stack = append(c.stack, &diffFrame{n: n, level: level - 1})
+	return nil
+}
+
+// Call fn for keys added, removed or changed between two committed
+// versions, in key order, until it returns false. Subtrees at the
+// same offset in both versions are unchanged and skipped, so only the
+// paths modified in between are read.
+func (tree *btree) Diff(oldVersion, newVersion Version, fn func(DiffEntry) bool) error {
+	var cursors [2]*diffCursor
+	for i, v := range []Version{oldVersion, newVersion} {
+		rootptr, err := tree.version_root(v)
+		if err != nil {
+			return err
+		}
+
+		cursors[i], err = tree.diff_cursor(rootptr)
+		if err != nil {
+			return err
+		}
+	}
+	oc, nc := cursors[0], cursors[1]
+
+	for {
+		var e DiffEntry
+		var err error
+
+		o, olevel := oc.head()
+		n, nlevel := nc.head()
+
+		switch {
+		case o == nil && n == nil:
+			return nil
+		case o != nil && n != nil && olevel > 0 && olevel == nlevel &&
+			bytes.Equal(o.v, n.v):
+			oc.next()
+			nc.next()
+			continue
+		case o != nil && olevel > 0 && olevel >= nlevel:
+			err = oc.expand()
+			if err == nil && olevel == nlevel {
+				err = nc.expand()
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		case n != nil && nlevel > 0:
+			err = nc.expand()
+			if err != nil {
+				return err
+			}
+			continue
+		case n == nil || o != nil && tree.cmp(&o.k, &n.k) < 0:
+			n = nil
+			oc.next()
+		case o == nil || tree.cmp(&o.k, &n.k) > 0:
+			o = nil
+			nc.next()
+		default:
+			oc.next()
+			nc.next()
+			if o.flags == n.flags && bytes.Equal(o.v, n.v) {
+				continue
+			}
+		}
+
+		// Tombstones count as absent keys
+		if o != nil && o.tombstone() {
+			o = nil
+		}
+		if n != nil && n.tombstone() {
+			n = nil
+		}
+
+		switch {
+		case o == nil && n == nil:
+			continue
+		case n == nil:
+			e = DiffEntry{Type: DIFF_REMOVED, Key: o.k}
+			e.Old, err = tree.resolve(o)
+		case o == nil:
+			e = DiffEntry{Type: DIFF_ADDED, Key: n.k}
+			e.New, err = tree.resolve(n)
+		default:
+			e = DiffEntry{Type: DIFF_CHANGED, Key: n.k}
+			e.Old, err = tree.resolve(o)
+			if err == nil {
+				e.New, err = tree.resolve(n)
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// Rewriting a value, e.g. into a new blob, does not change it
+		if e.Type == DIFF_CHANGED && o.expires == n.expires && bytes.Equal(e.Old, e.New) {
+			continue
+		}
+
+		if !fn(e) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	os.Remove(TEST_FILE)
+	defer os.Remove(TEST_FILE)
+
+	config := DefaultConfig()
+	config.kvChunkSize = KV_CHUNKSIZE
+	config.kpChunkSize = KP_CHUNKSIZE
+	tree, err := Open(TEST_FILE, config)
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+	defer tree.Close()
+
+	model := make(map[string]string)
+	for i := 0; i < 2000; i++ {
+		tree.Insert(make_key(i), make_value(i))
+		model[string(make_key(i))] = string(make_value(i))
+	}
+	tree.Flush()
+	versions, _ := tree.Versions()
+	old := versions[0]
+
+	expected := make(map[string]DiffEntry)
+	for i := 0; i < 50; i++ {
+		id := rand.Intn(2500)
+		k := string(make_key(id))
+		v, present := model[k]
+		e, seen := expected[k]
+		if !seen {
+			e = DiffEntry{Type: DIFF_ADDED, Key: Key(k)}
+			if present {
+				e = DiffEntry{Type: DIFF_CHANGED, Key: Key(k), Old: Value(v)}
+			}
+		}
+
+		if present && rand.Intn(2) == 0 {
+			tree.Remove(Key(k))
+			delete(model, k)
+			e.New = nil
+			e.Type = DIFF_REMOVED
+		} else {
+			nv := Value(fmt.Sprintf("new_%d", i))
+			tree.Insert(Key(k), nv)
+			model[k] = string(nv)
+			e.New = nv
+			e.Type = DIFF_CHANGED
+			if e.Old == nil {
+				e.Type = DIFF_ADDED
+			}
+		}
+
+		if e.Type == DIFF_REMOVED && e.Old == nil {
+			delete(expected, k)
+		} else {
+			expected[k] = e
+		}
+	}
+	tree.Flush()
+	versions, _ = tree.Versions()
+
+	found := make(map[string]DiffEntry)
+	err = tree.Diff(old, versions[0], func(e DiffEntry) bool {
+		found[string(e.Key)] = e
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Diff failed (%s)", err)
+	}
+
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("Unexpected diff %v, expected %v", found, expected)
+	}
+
+	count := 0
+	tree.Diff(old, old, func(e DiffEntry) bool {
+		count++
+		return true
+	})
+	if count != 0 {
+		t.Errorf("Expected no differences for the same version, found %d", count)
+	}
+
+	err = tree.Diff(Version{old.Generation, old.Offset + 1}, versions[0], func(e DiffEntry) bool { return true })
+	if err != ErrVersionNotFound {
+		t.Errorf("Expected version not found (%v)", err)
+	}
+}
+
+func TestDiffBlobs(t *testing.T) {
+	os.Remove(TEST_FILE)
+	defer os.Remove(TEST_FILE)
+
+	config := DefaultConfig()
+	config.BlobThreshold = 16
+	tree, err := Open(TEST_FILE, config)
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+	defer tree.Close()
+
+	large := Value("a value stored out of line as a blob")
+	tree.Insert(make_key(1), large)
+	tree.Insert(make_key(2), large)
+	tree.Flush()
+	versions, _ := tree.Versions()
+	old := versions[0]
+
+	// Same value in a new blob, and a new value
+	tree.Insert(make_key(1), large)
+	tree.Insert(make_key(2), append(Value("changed "), large...))
+	tree.Flush()
+	versions, _ = tree.Versions()
+
+	var found []string
+	tree.Diff(old, versions[0], func(e DiffEntry) bool {
+		found = append(found, string(e.Key))
+		return true
+	})
+
+	if !reflect.DeepEqual(found, []string{string(make_key(2))}) {
+		t.Errorf("Expected only key_2 changed, found %v", found)
+	}
+}
@@ -0,0 +1,242 @@
+package btree
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"time"
+	"unicode/utf8"
+)
+
+// Dump formats
+const (
+	DUMP_JSON = iota
+	DUMP_BINARY
+	// Graphviz, only for tree structure
+	DUMP_DOT
+)
+
+// Leading bytes of a binary dump
+const DUMP_MAGIC = "GBTD"
+
+// Key length marking the end of a binary dump, followed by the uint64
+// item count
+const dumpEnd = math.MaxUint32
+
+var errTruncatedDump = errors.New("Dump is truncated")
+
+// JSON Lines record, non UTF-8 keys and values are base64 encoded
+type dumpRecord struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	KeyBase64   bool   `json:"key_base64,omitempty"`
+	ValueBase64 bool   `json:"value_base64,omitempty"`
+	// Expiry time in unix nanoseconds, omitted if the item does not expire
+	Expires int64 `json:"expires,omitempty"`
+	// Set on the last record, which only holds the item count
+	End   bool   `json:"end,omitempty"`
+	Count uint64 `json:"count,omitempty"`
+}
+
+// Last record of a JSON Lines dump
+type dumpTrailer struct {
+	End   bool   `json:"end"`
+	Count uint64 `json:"count"`
+}
+
+func encodeField(b []byte) (string, bool) {
+	if utf8.Valid(b) {
+		return string(b), false
+	}
+
+	return base64.StdEncoding.EncodeToString(b), true
+}
+
+func decodeField(s string, b64 bool) ([]byte, error) {
+	if b64 {
+		return base64.StdEncoding.DecodeString(s)
+	}
+
+	return []byte(s), nil
+}
+
+// Write all items of the tree to w, with their expiry. Items are streamed from a snapshot
+// of the current root, so concurrent modifications are not visible.
+// The dump ends with the item count, so that Restore can tell a
+// complete dump from a truncated one.
+func (tree *btree) Dump(w io.Writer, format int) error {
+	var err error
+	var count uint64
+	var write func(itm kv) error
+	var end func() error
+
+	bw := bufio.NewWriter(w)
+	switch format {
+	case DUMP_JSON:
+		enc := json.NewEncoder(bw)
+		write = func(itm kv) error {
+			var rec dumpRecord
+			rec.Key, rec.KeyBase64 = encodeField(itm.k)
+			rec.Value, rec.ValueBase64 = encodeField(itm.v)
+			rec.Expires = itm.expires
+			return enc.Encode(&rec)
+		}
+		end = func() error {
+			return enc.Encode(&dumpTrailer{End: true, Count: count})
+		}
+	case DUMP_BINARY:
+		bw.WriteString(DUMP_MAGIC)
+		write = func(itm kv) error {
+			// Only the expiry is kept, values are resolved inline
+			itm.flags = 0
+			if len(itm.v) > valueLenMask {
+				return ErrValueTooLarge
+			}
+			_, err := bw.Write(itm.Bytes())
+			return err
+		}
+		end = func() error {
+			binary.Write(bw, binary.LittleEndian, uint32(dumpEnd))
+			return binary.Write(bw, binary.LittleEndian, count)
+		}
+	default:
+		return errors.New("Unknown dump format")
+	}
+
+	allquery := &QueryRequest{
+		Keys: []*Key{nil, nil},
+		Callback: func(itm kv) {
+			if err == nil {
+				err = write(itm)
+				count++
+			}
+		},
+		Range: true,
+	}
+
+	qerr := tree.snapshot().query(allquery)
+	if qerr != nil {
+		return qerr
+	}
+	if err == nil {
+		err = end()
+	}
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// Iterator over items of a dump stream. Iteration stops with err set
+// if the stream ends before the trailer or its item count is wrong.
+type dumpIter struct {
+	r     *bufio.Reader
+	dec   *json.Decoder
+	next  *kv
+	count uint64
+	err   error
+}
+
+func (it *dumpIter) fetch() {
+	var end bool
+	var count uint64
+
+	itm := new(kv)
+	if it.dec != nil {
+		var rec dumpRecord
+		it.err = it.dec.Decode(&rec)
+		end, count = rec.End, rec.Count
+		if it.err == nil && !end {
+			itm.k, it.err = decodeField(rec.Key, rec.KeyBase64)
+		}
+		if it.err == nil && !end {
+			itm.v, it.err = decodeField(rec.Value, rec.ValueBase64)
+			itm.expires = rec.Expires
+		}
+	} else {
+		var marker []byte
+		marker, it.err = it.r.Peek(4)
+		switch {
+		case it.err != nil:
+		case binary.LittleEndian.Uint32(marker) == dumpEnd:
+			end = true
+			it.r.Discard(4)
+			it.err = binary.Read(it.r, binary.LittleEndian, &count)
+		default:
+			it.err = itm.Read(it.r)
+			if it.err == nil && itm.flags != 0 {
+				it.err = errors.New("Invalid item in binary dump")
+			}
+		}
+	}
+
+	it.next = nil
+	switch {
+	case it.err == io.EOF || it.err == io.ErrUnexpectedEOF:
+		it.err = errTruncatedDump
+	case it.err != nil:
+	case end && count != it.count:
+		it.err = errors.New("Dump item count mismatch")
+	case !end:
+		it.next = itm
+		it.count++
+	}
+}
+
+func (it *dumpIter) HasNext() bool {
+	return it.next != nil
+}
+
+func (it *dumpIter) Next() (Key, Value) {
+	itm := it.next
+	it.fetch()
+	return itm.k, itm.v
+}
+
+func (it *dumpIter) NextExpiry() (Key, Value, time.Time) {
+	var t time.Time
+	itm := it.next
+	it.fetch()
+	if itm.expires != 0 {
+		t = time.Unix(0, itm.expires)
+	}
+	return itm.k, itm.v, t
+}
+
+// Replace contents of the tree with a dump written by Dump. The
+// format is detected from the stream. The whole stream is decoded
+// before the new contents are committed, so a damaged or truncated
+// dump leaves the tree unchanged.
+func (tree *btree) Restore(r io.Reader) error {
+	it := &dumpIter{r: bufio.NewReader(r)}
+
+	magic, err := it.r.Peek(len(DUMP_MAGIC))
+	switch {
+	case err == nil && string(magic) == DUMP_MAGIC:
+		it.r.Discard(len(DUMP_MAGIC))
+	case len(magic) > 0 && magic[0] == '{':
+		it.dec = json.NewDecoder(it.r)
+	default:
+		return errors.New("Unknown dump format")
+	}
+
+	it.fetch()
+	if it.err != nil {
+		return it.err
+	}
+
+	root, err := tree.bulk_build(it)
+	if err == nil {
+		err = it.err
+	}
+	if err != nil {
+		return err
+	}
+
+	return tree.bulk_commit(root)
+}
@@ -0,0 +1,192 @@
+package btree
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDumpRestore(t *testing.T) {
+	tree := initTree()
+	tree.cmp, _ = lookupComparator(DEFAULT_COMPARATOR)
+	buildTestTree(tree, 1000)
+
+	// Non UTF-8 key and value
+	rq := &ModifyRequest{
+		ops: []Operation{
+			Operation{itm: kv{k: Key("\xff\xfe"), v: Value("\x00\xff")}, op: OP_INSERT},
+		},
+	}
+	err := tree.modify(rq)
+	if err != nil {
+		t.Fatalf("modify returned non-nil error (%s)", err)
+	}
+
+	expected := []kv{}
+	qreq := &QueryRequest{
+		Keys: []*Key{nil, nil},
+		Callback: func(itm kv) {
+			expected = append(expected, itm)
+		},
+		Range: true,
+	}
+	tree.query(qreq)
+
+	for _, format := range []int{DUMP_JSON, DUMP_BINARY} {
+		buf := new(bytes.Buffer)
+		err = tree.Dump(buf, format)
+		if err != nil {
+			t.Fatalf("Dump failed (%s)", err)
+		}
+
+		if format == DUMP_JSON && !strings.Contains(buf.String(), `"key_base64":true`) {
+			t.Errorf("Expected base64 encoded key in JSON dump")
+		}
+
+		tree2 := initTree()
+		tree2.cmp = tree.cmp
+		err = tree2.Restore(buf)
+		if err != nil {
+			t.Fatalf("Restore failed (%s)", err)
+		}
+
+		received := []kv{}
+		qreq.Callback = func(itm kv) {
+			received = append(received, itm)
+		}
+		tree2.query(qreq)
+
+		if len(received) != len(expected) {
+			t.Fatalf("Expected %d items after restore, found %d", len(expected), len(received))
+		}
+
+		for i := range expected {
+			if !equals(received[i], expected[i]) {
+				t.Fatalf("Unexpected item after restore %q", string(received[i].k))
+			}
+		}
+	}
+
+	err = tree.Restore(strings.NewReader("garbage"))
+	if err == nil {
+		t.Errorf("Expected error restoring unknown format")
+	}
+}
+
+func TestRestoreTruncated(t *testing.T) {
+	tree := initTree()
+	tree.cmp, _ = lookupComparator(DEFAULT_COMPARATOR)
+	buildTestTree(tree, 1000)
+
+	count := func(tree *btree) int {
+		n := 0
+		tree.query(&QueryRequest{
+			Keys:     []*Key{nil, nil},
+			Callback: func(itm kv) { n++ },
+			Range:    true,
+		})
+		return n
+	}
+
+	for _, format := range []int{DUMP_JSON, DUMP_BINARY} {
+		buf := new(bytes.Buffer)
+		tree.Dump(buf, format)
+
+		// Contents to preserve differ from the dump
+		rq := &ModifyRequest{
+			ops: []Operation{
+				Operation{itm: kv{k: Key("extra" + string(rune('0'+format))), v: Value("v")}, op: OP_INSERT},
+			},
+		}
+		tree.modify(rq)
+		tree.write_header()
+		expected := count(tree)
+
+		// Cut in the middle and right before the trailer
+		b := buf.Bytes()
+		trailer := len(b) - 12
+		if format == DUMP_JSON {
+			trailer = bytes.LastIndexByte(b[:len(b)-1], '\n') + 1
+		}
+
+		for _, l := range []int{len(b)/2 + 1, trailer} {
+			err := tree.Restore(bytes.NewReader(b[:l]))
+			if err == nil {
+				t.Errorf("Expected error restoring a dump truncated to %d of %d bytes", l, len(b))
+			}
+
+			if n := count(tree); n != expected {
+				t.Errorf("Expected previous %d items after failed restore, found %d", expected, n)
+			}
+
+			// Nothing was committed either
+			tree2 := openTree()
+			tree2.cmp = tree.cmp
+			tree2.read_header()
+			if n := count(tree2); n != expected {
+				t.Errorf("Expected %d committed items after failed restore, found %d", expected, n)
+			}
+			tree2.file.Close()
+		}
+	}
+}
+
+func TestDumpExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	tree := initTree()
+	tree.cmp, _ = lookupComparator(DEFAULT_COMPARATOR)
+	for i := 0; i < 10; i++ {
+		tree.Insert(make_key(i), make_value(i))
+	}
+	tree.InsertWithTTL(make_key(3), make_value(3), time.Minute)
+	tree.InsertWithTTL(make_key(4), make_value(4), time.Hour)
+
+	for _, format := range []int{DUMP_JSON, DUMP_BINARY} {
+		buf := new(bytes.Buffer)
+		err := tree.Dump(buf, format)
+		if err != nil {
+			t.Fatalf("Dump failed (%s)", err)
+		}
+
+		if format == DUMP_JSON && !strings.Contains(buf.String(), `"expires":`) {
+			t.Errorf("Expected expiry in JSON dump")
+		}
+
+		tree2 := initTree()
+		tree2.cmp = tree.cmp
+		err = tree2.Restore(buf)
+		if err != nil {
+			t.Fatalf("Restore failed (%s)", err)
+		}
+
+		expires := make(map[string]int64)
+		tree2.query(&QueryRequest{
+			Keys: []*Key{nil, nil},
+			Callback: func(itm kv) {
+				expires[string(itm.k)] = itm.expires
+			},
+			Range: true,
+		})
+
+		if len(expires) != 10 || !tree2.expiring {
+			t.Fatalf("Expected 10 items with expiry enabled, found %d (%v)", len(expires), tree2.expiring)
+		}
+		for i := 0; i < 10; i++ {
+			var want int64
+			switch i {
+			case 3:
+				want = now.Add(time.Minute).UnixNano()
+			case 4:
+				want = now.Add(time.Hour).UnixNano()
+			}
+			if expires[string(make_key(i))] != want {
+				t.Errorf("Expected expiry %d for %s, found %d", want, make_key(i), expires[string(make_key(i))])
+			}
+		}
+		tree2.Close()
+	}
+}
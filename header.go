@@ -5,40 +5,285 @@ import (
 	"encoding/binary"
 	"errors"
 	"hash/crc32"
+	"math"
+	"math/rand"
 )
 
 const (
-	HEADER_SIZE = 4 + 8
-	BLOCK_SIZE  = 4096
+	HEADER_MAGIC   = "GBTR"
+	FORMAT_VERSION = 2
+	// Files written before headers carried a magic and version
+	LEGACY_VERSION = 1
+	HEADER_SIZE    = 4 + 4 + 2 + 4 + 3*4 + 8 + 2
+	BLOCK_SIZE     = 4096
+	// Headers with a large catalog may span several blocks
+	MAX_HEADER_SIZE = 16 * BLOCK_SIZE
+	// Root pointer of an empty tree
+	EMPTY_ROOT = -1
 )
 
-type header struct {
+// Feature flags
+const (
+	FEATURE_COMPRESSION = 1 << iota
+	FEATURE_BLOBS
+	FEATURE_NODE_CHECKSUMS
+	FEATURE_CATALOG
+	FEATURE_EXPIRY
+	FEATURE_TOMBSTONES
+	// Header records the codec name and compression statistics
+	FEATURE_CODEC
+	// Header records the generation of the file
+	FEATURE_GENERATION
+	// Header records the highest sequence number of each tree
+	FEATURE_SEQUENCES
+
+	FEATURES_KNOWN = FEATURE_COMPRESSION | FEATURE_BLOBS | FEATURE_NODE_CHECKSUMS |
+		FEATURE_CATALOG | FEATURE_EXPIRY | FEATURE_TOMBSTONES | FEATURE_CODEC |
+		FEATURE_GENERATION | FEATURE_SEQUENCES
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("Unsupported btree format version")
+	ErrUpgradeRequired    = errors.New("Btree file uses a legacy format, upgrade required")
+	ErrHeaderTooLarge     = errors.New("Header exceeds the maximum size, too many or too long tree names")
+
+	errShortHeader = errors.New("Header too short")
+)
+
+// Root of a named tree stored in the header catalog
+type catalogEntry struct {
+	name    string
 	rootptr int64
+	cmp     string
 }
 
-func (h *header) Bytes() []byte {
-	diskbuf := new(bytes.Buffer)
+// Highest sequence number assigned by a tree, "" names the default tree
+type seqMark struct {
+	name string
+	seq  uint64
+}
+
+type header struct {
+	version  uint16
+	features uint32
+	// Config snapshot
+	kvChunkSize   uint32
+	kpChunkSize   uint32
+	blobThreshold uint32
+	rootptr       int64
+	// Name of the comparator the tree was built with
+	cmp string
+	// Named trees, present with FEATURE_CATALOG
+	trees []catalogEntry
+	// Codec of compressed nodes and statistics of the nodes written,
+	// present with FEATURE_CODEC
+	codec string
+	stats Stats
+	// Generation of the file, present with FEATURE_GENERATION
+	generation uint64
+	// Sorted by name, present with FEATURE_SEQUENCES
+	seqs []seqMark
+}
+
+// Random identifier of a new generation of a file, never 0
+func new_generation() uint64 {
+	for {
+		if g := rand.Uint64(); g != 0 {
+			return g
+		}
+	}
+}
+
+func writeString(w *bytes.Buffer, s string) {
+	binary.Write(w, binary.LittleEndian, uint16(len(s)))
+	w.WriteString(s)
+}
+
+func (h *header) content() []byte {
 	content := new(bytes.Buffer)
+	binary.Write(content, binary.LittleEndian, h.version)
+	binary.Write(content, binary.LittleEndian, h.features)
+	binary.Write(content, binary.LittleEndian, h.kvChunkSize)
+	binary.Write(content, binary.LittleEndian, h.kpChunkSize)
+	binary.Write(content, binary.LittleEndian, h.blobThreshold)
 	binary.Write(content, binary.LittleEndian, h.rootptr)
+	writeString(content, h.cmp)
+
+	if h.features&FEATURE_CATALOG != 0 {
+		binary.Write(content, binary.LittleEndian, uint16(len(h.trees)))
+		for _, e := range h.trees {
+			writeString(content, e.name)
+			binary.Write(content, binary.LittleEndian, e.rootptr)
+			writeString(content, e.cmp)
+		}
+	}
+
+	if h.features&FEATURE_CODEC != 0 {
+		writeString(content, h.codec)
+		binary.Write(content, binary.LittleEndian, h.stats.CompressedNodes)
+		binary.Write(content, binary.LittleEndian, h.stats.RawBytes)
+		binary.Write(content, binary.LittleEndian, h.stats.StoredBytes)
+	}
+
+	if h.features&FEATURE_GENERATION != 0 {
+		binary.Write(content, binary.LittleEndian, h.generation)
+	}
+
+	if h.features&FEATURE_SEQUENCES != 0 {
+		binary.Write(content, binary.LittleEndian, uint16(len(h.seqs)))
+		for _, m := range h.seqs {
+			writeString(content, m.name)
+			binary.Write(content, binary.LittleEndian, m.seq)
+		}
+	}
+
+	return content.Bytes()
+}
+
+// Check that the header can be written and read back
+func (h *header) check() error {
+	if len(h.trees) > math.MaxUint16 || len(h.seqs) > math.MaxUint16 || len(h.Bytes()) > MAX_HEADER_SIZE {
+		return ErrHeaderTooLarge
+	}
+
+	for _, e := range h.trees {
+		if len(e.name) > math.MaxUint16 || len(e.cmp) > math.MaxUint16 {
+			return ErrHeaderTooLarge
+		}
+	}
+
+	return nil
+}
 
-	cksum := crc32.ChecksumIEEE(content.Bytes())
+func (h *header) Bytes() []byte {
+	diskbuf := new(bytes.Buffer)
+	content := h.content()
+
+	cksum := crc32.ChecksumIEEE(content)
+	diskbuf.WriteString(HEADER_MAGIC)
 	binary.Write(diskbuf, binary.LittleEndian, cksum)
-	binary.Write(diskbuf, binary.LittleEndian, content.Bytes())
+	binary.Write(diskbuf, binary.LittleEndian, content)
 
 	return diskbuf.Bytes()
 }
 
+// Parse header, errShortHeader is returned if b ends before the
+// header does
 func (h *header) Parse(b []byte) error {
 	var cksum uint32
-	diskbuf := bytes.NewBuffer(b)
+	var short bool
+
+	if len(b) < len(HEADER_MAGIC) || string(b[:len(HEADER_MAGIC)]) != HEADER_MAGIC {
+		return h.parseLegacy(b)
+	}
+
+	if len(b) < HEADER_SIZE {
+		return errShortHeader
+	}
 
+	diskbuf := bytes.NewBuffer(b[len(HEADER_MAGIC):])
+	read := func(v interface{}) {
+		if binary.Read(diskbuf, binary.LittleEndian, v) != nil {
+			short = true
+		}
+	}
+	readString := func() string {
+		var l uint16
+		read(&l)
+		if int(l) > diskbuf.Len() {
+			short = true
+			return ""
+		}
+		return string(diskbuf.Next(int(l)))
+	}
+
+	read(&cksum)
+	read(&h.version)
+	read(&h.features)
+	read(&h.kvChunkSize)
+	read(&h.kpChunkSize)
+	read(&h.blobThreshold)
+	read(&h.rootptr)
+	h.cmp = readString()
+
+	h.trees = nil
+	if h.features&FEATURE_CATALOG != 0 {
+		var count uint16
+		read(&count)
+		for i := 0; i < int(count) && !short; i++ {
+			var e catalogEntry
+			e.name = readString()
+			read(&e.rootptr)
+			e.cmp = readString()
+			h.trees = append(h.trees, e)
+		}
+	}
+
+	h.codec, h.stats = "", Stats{}
+	if h.features&FEATURE_CODEC != 0 {
+		h.codec = readString()
+		read(&h.stats.CompressedNodes)
+		read(&h.stats.RawBytes)
+		read(&h.stats.StoredBytes)
+	}
+
+	h.generation = 0
+	if h.features&FEATURE_GENERATION != 0 {
+		read(&h.generation)
+	}
+
+	h.seqs = nil
+	if h.features&FEATURE_SEQUENCES != 0 {
+		var count uint16
+		read(&count)
+		for i := 0; i < int(count) && !short; i++ {
+			var m seqMark
+			m.name = readString()
+			read(&m.seq)
+			h.seqs = append(h.seqs, m)
+		}
+	}
+
+	if short {
+		return errShortHeader
+	}
+
+	if crc32.ChecksumIEEE(h.content()) != cksum {
+		return errors.New("Header checksum mismatch")
+	}
+
+	return nil
+}
+
+// Parse a header written without magic and version. The comparator
+// name was a later addition, so both layouts are accepted.
+func (h *header) parseLegacy(b []byte) error {
+	var cksum uint32
+	var l uint16
+
+	*h = header{version: LEGACY_VERSION}
+	diskbuf := bytes.NewBuffer(b)
 	binary.Read(diskbuf, binary.LittleEndian, &cksum)
-	binary.Read(diskbuf, binary.LittleEndian, &h.rootptr)
+	err := binary.Read(diskbuf, binary.LittleEndian, &h.rootptr)
+	if err != nil {
+		return errShortHeader
+	}
+
 	content := new(bytes.Buffer)
 	binary.Write(content, binary.LittleEndian, h.rootptr)
-	cksum_calc := crc32.ChecksumIEEE(content.Bytes())
+	if crc32.ChecksumIEEE(content.Bytes()) == cksum {
+		return nil
+	}
+
+	err = binary.Read(diskbuf, binary.LittleEndian, &l)
+	if err != nil || int(l) > diskbuf.Len() {
+		return errors.New("Header checksum mismatch")
+	}
+	h.cmp = string(diskbuf.Next(int(l)))
+	binary.Write(content, binary.LittleEndian, l)
+	content.WriteString(h.cmp)
 
-	if cksum_calc != cksum {
+	if crc32.ChecksumIEEE(content.Bytes()) != cksum {
 		return errors.New("Header checksum mismatch")
 	}
 
@@ -0,0 +1,221 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func buildTestTree(tree *btree, N int) {
+	var n node
+	for i := 0; i < N; i++ {
+		itm := new(kv)
+		itm.k = Key(fmt.Sprintf("key_%04d", i))
+		itm.v = Value(fmt.Sprintf("val_%d", i))
+		n.kvlist = append(n.kvlist, itm)
+	}
+
+	tree.build(n.kvlist)
+}
+
+// Write a header in the format used before magic and versions
+func writeLegacyHeader(tree *btree) {
+	rootptr, _ := tree.writeNode(tree.root)
+	content := new(bytes.Buffer)
+	binary.Write(content, binary.LittleEndian, rootptr)
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(content.Bytes()))
+	buf.Write(content.Bytes())
+
+	headerpos := tree.offset + (BLOCK_SIZE - (tree.offset % BLOCK_SIZE))
+	tree.file.WriteAt(buf.Bytes(), headerpos)
+}
+
+func TestHeaderVersions(t *testing.T) {
+	h := header{version: FORMAT_VERSION, rootptr: 100, cmp: "bytes", kvChunkSize: 10}
+	var h2 header
+	err := h2.Parse(h.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to parse header (%s)", err)
+	}
+
+	if !reflect.DeepEqual(h2, h) {
+		t.Errorf("Parsed header differs %v != %v", h2, h)
+	}
+
+	h.features = FEATURE_CATALOG
+	h.trees = []catalogEntry{{"by-seq", 200, "bytes"}, {"local", EMPTY_ROOT, "reverse"}}
+	err = h2.Parse(h.Bytes())
+	if err != nil || !reflect.DeepEqual(h2, h) {
+		t.Errorf("Parsed header with catalog differs %v != %v (%v)", h2, h, err)
+	}
+
+	if h2.Parse(h.Bytes()[:HEADER_SIZE+4]) != errShortHeader {
+		t.Errorf("Expected short header error")
+	}
+
+	b := h.Bytes()
+	b[len(b)-1] ^= 0xff
+	if h2.Parse(b) == nil {
+		t.Errorf("Expected checksum mismatch")
+	}
+
+	tree := initTree()
+	tree.cmpName = DEFAULT_COMPARATOR
+	buildTestTree(tree, 100)
+	h = header{version: FORMAT_VERSION + 1}
+	h.rootptr, _ = tree.writeNode(tree.root)
+	tree.file.WriteAt(h.Bytes(), tree.offset+(BLOCK_SIZE-(tree.offset%BLOCK_SIZE)))
+	tree.Close()
+
+	_, err = Open(TEST_FILE, DefaultConfig())
+	if err != ErrUnsupportedVersion {
+		t.Errorf("Expected unsupported version error, got %v", err)
+	}
+
+	os.Remove(TEST_FILE)
+	f, _ := os.Create(TEST_FILE)
+	f.Write(bytes.Repeat([]byte("junk"), 3000))
+	f.Close()
+	_, err = Open(TEST_FILE, DefaultConfig())
+	if err == nil {
+		t.Errorf("Expected error opening a non btree file")
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	tree := initTree()
+	tree.cmp, _ = lookupComparator(DEFAULT_COMPARATOR)
+	buildTestTree(tree, 1000)
+	writeLegacyHeader(tree)
+	tree.Close()
+
+	_, err := Open(TEST_FILE, DefaultConfig())
+	if err != ErrUpgradeRequired {
+		t.Fatalf("Expected upgrade required error, got %v", err)
+	}
+
+	config := DefaultConfig()
+	config.Comparator = DEFAULT_COMPARATOR
+	err = Upgrade(TEST_FILE, config)
+	if err != nil {
+		t.Fatalf("Upgrade failed (%s)", err)
+	}
+
+	tree, err = open_file(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open upgraded file (%s)", err)
+	}
+	defer tree.Close()
+
+	count := 0
+	qreq := &QueryRequest{
+		Keys: []*Key{nil, nil},
+		Callback: func(itm kv) {
+			count++
+		},
+		Range: true,
+	}
+
+	err = tree.query(qreq)
+	if err != nil {
+		t.Fatalf("query returned non-nil error (%s)", err)
+	}
+
+	if count != 1000 {
+		t.Errorf("Expected 1000 items after upgrade, found %d", count)
+	}
+
+	if tree.cmpName != DEFAULT_COMPARATOR {
+		t.Errorf("Expected %s comparator after upgrade, found %s", DEFAULT_COMPARATOR, tree.cmpName)
+	}
+}
+
+func TestUpgradeComparator(t *testing.T) {
+	RegisterComparator("reverse", func(k1, k2 Key) int {
+		return bytes.Compare(k2, k1)
+	})
+
+	// Legacy file written in reverse order
+	tree := initTree()
+	tree.cmp, _ = lookupComparator("reverse")
+	var n node
+	for i := 99; i >= 0; i-- {
+		n.kvlist = append(n.kvlist, &kv{k: Key(fmt.Sprintf("key_%04d", i)), v: make_value(i)})
+	}
+	tree.build(n.kvlist)
+	writeLegacyHeader(tree)
+	tree.Close()
+
+	// Files without a comparator name need it to be given
+	err := Upgrade(TEST_FILE, DefaultConfig())
+	if err == nil {
+		t.Errorf("Expected error upgrading a legacy file without a comparator")
+	}
+
+	config := DefaultConfig()
+	config.Comparator = "reverse"
+	err = Upgrade(TEST_FILE, config)
+	if err != nil {
+		t.Fatalf("Upgrade failed (%s)", err)
+	}
+
+	// The given comparator is recorded
+	tree, err = open_file(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open upgraded file (%s)", err)
+	}
+	defer tree.Close()
+
+	if tree.cmpName != "reverse" {
+		t.Errorf("Expected reverse comparator, found %s", tree.cmpName)
+	}
+	for i := 0; i < 100; i++ {
+		_, err = tree.Get(Key(fmt.Sprintf("key_%04d", i)))
+		if err != nil {
+			t.Errorf("Failed to find key %d after upgrade (%s)", i, err)
+		}
+	}
+
+	config.Comparator = DEFAULT_COMPARATOR
+	_, err = Open(TEST_FILE, config)
+	if err == nil {
+		t.Errorf("Expected comparator mismatch opening the upgraded file")
+	}
+}
+
+func TestHeaderConfig(t *testing.T) {
+	os.Remove(TEST_FILE)
+	defer os.Remove(TEST_FILE)
+
+	config := DefaultConfig()
+	config.kvChunkSize = KV_CHUNKSIZE
+	config.kpChunkSize = KP_CHUNKSIZE
+	config.BlobThreshold = 16
+	tree, err := open_file(TEST_FILE, config)
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+	tree.Insert(make_key(1), make_value(1))
+	tree.Flush()
+	tree.Close()
+
+	// Settings recorded in the file apply when reopened with defaults
+	tree, err = open_file(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to reopen tree (%s)", err)
+	}
+	defer tree.Close()
+
+	if tree.config.kvChunkSize != KV_CHUNKSIZE || tree.config.kpChunkSize != KP_CHUNKSIZE {
+		t.Errorf("Expected chunk sizes %d/%d, found %d/%d", KV_CHUNKSIZE, KP_CHUNKSIZE,
+			tree.config.kvChunkSize, tree.config.kpChunkSize)
+	}
+	if tree.config.BlobThreshold != 16 {
+		t.Errorf("Expected blob threshold 16, found %d", tree.config.BlobThreshold)
+	}
+}
@@ -0,0 +1,104 @@
+package btree
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Builtin merge functions
+const (
+	// Concatenate operands to the value
+	MERGE_APPEND = "append"
+	// Add operands to the value, both int64 little endian
+	MERGE_ADD = "add"
+)
+
+var (
+	mergesLock sync.RWMutex
+	merges     = map[string]func(Key, Value, Value) Value{
+		MERGE_APPEND: func(k Key, v, operand Value) Value {
+			return append(append(Value{}, v...), operand...)
+		},
+		MERGE_ADD: func(k Key, v, operand Value) Value {
+			var n, d int64
+			if len(v) == 8 {
+				n = int64(binary.LittleEndian.Uint64(v))
+			}
+			if len(operand) == 8 {
+				d = int64(binary.LittleEndian.Uint64(operand))
+			}
+			return binary.LittleEndian.AppendUint64(nil, uint64(n+d))
+		},
+	}
+)
+
+// Register a named merge function. It is called with the key, the
+// current value, nil if the key is absent, and an operand, and returns
+// the new value.
+func RegisterMerge(name string, fn func(k Key, v, operand Value) Value) {
+	mergesLock.Lock()
+	defer mergesLock.Unlock()
+	merges[name] = fn
+}
+
+func lookupMerge(name string) (func(Key, Value, Value) Value, error) {
+	mergesLock.RLock()
+	defer mergesLock.RUnlock()
+	fn, ok := merges[name]
+	if !ok {
+		return nil, errors.New("Merge function not registered: " + name)
+	}
+
+	return fn, nil
+}
+
+// Operand to merge into the value of a key
+type MergeOperand struct {
+	Key     Key
+	Operand Value
+}
+
+// Merge operands into the current values of their keys with a
+// registered merge function, without reading them first. Operands for
+// the same key are applied in the order given, all in a single
+// modification of the tree.
+func (tree *btree) Merge(name string, operands ...MergeOperand) error {
+	return tree.MergeContext(context.Background(), name, operands...)
+}
+
+// Merge that is abandoned with ctx.Err() once ctx is done, leaving the
+// tree unchanged
+func (tree *btree) MergeContext(ctx context.Context, name string, operands ...MergeOperand) error {
+	fn, err := lookupMerge(name)
+	if err != nil {
+		return err
+	}
+
+	sorted := make([]MergeOperand, len(operands))
+	copy(sorted, operands)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return tree.cmp(&sorted[i].Key, &sorted[j].Key) < 0
+	})
+
+	var ops []Operation
+	for i, m := range sorted {
+		if i > 0 && tree.cmp(&m.Key, &sorted[i-1].Key) == 0 {
+			op := &ops[len(ops)-1]
+			op.operands = append(op.operands, m.Operand)
+			continue
+		}
+
+		ops = append(ops, Operation{
+			itm:      kv{k: m.Key},
+			op:       OP_MERGE,
+			merge:    fn,
+			operands: []Value{m.Operand},
+		})
+	}
+
+	_, err = tree.modify_ctx(ctx, ops...)
+	return err
+}
@@ -0,0 +1,76 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	os.Remove(TEST_FILE)
+	defer os.Remove(TEST_FILE)
+
+	config := DefaultConfig()
+	config.BlobThreshold = 16
+	tree, err := Open(TEST_FILE, config)
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+	defer tree.Close()
+
+	one := binary.LittleEndian.AppendUint64(nil, 1)
+	var ops []MergeOperand
+	for i := 0; i < 100; i++ {
+		ops = append(ops, MergeOperand{Key: make_key(i % 3), Operand: one})
+	}
+	err = tree.Merge(MERGE_ADD, ops...)
+	if err != nil {
+		t.Fatalf("Merge failed (%s)", err)
+	}
+	tree.Merge(MERGE_ADD, MergeOperand{Key: make_key(0), Operand: one})
+
+	for i, expected := range []uint64{35, 33, 33} {
+		v, err := tree.Get(make_key(i))
+		if err != nil || binary.LittleEndian.Uint64(v) != expected {
+			t.Errorf("Expected counter %d for %s (%v)", expected, make_key(i), err)
+		}
+	}
+
+	long := Value("a value stored out of line as a blob")
+	tree.Insert(make_key(10), long)
+	err = tree.Merge(MERGE_APPEND,
+		MergeOperand{Key: make_key(10), Operand: Value("+a")},
+		MergeOperand{Key: make_key(11), Operand: Value("b")},
+		MergeOperand{Key: make_key(10), Operand: Value("+c")})
+	if err != nil {
+		t.Fatalf("Merge failed (%s)", err)
+	}
+
+	v, _ := tree.Get(make_key(10))
+	if !bytes.Equal(v, append(long, "+a+c"...)) {
+		t.Errorf("Unexpected appended value %s", v)
+	}
+	v, _ = tree.Get(make_key(11))
+	if string(v) != "b" {
+		t.Errorf("Unexpected value for absent key %s", v)
+	}
+
+	RegisterMerge("max", func(k Key, v, operand Value) Value {
+		if bytes.Compare(operand, v) > 0 {
+			return operand
+		}
+		return v
+	})
+	tree.Merge("max", MergeOperand{Key: make_key(11), Operand: Value("a")},
+		MergeOperand{Key: make_key(11), Operand: Value("c")})
+	v, _ = tree.Get(make_key(11))
+	if string(v) != "c" {
+		t.Errorf("Unexpected value from registered merge %s", v)
+	}
+
+	err = tree.Merge("unknown", MergeOperand{Key: make_key(1)})
+	if err == nil {
+		t.Error("Expected error for unregistered merge function")
+	}
+}
@@ -1,10 +1,15 @@
 package btree
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"io"
-	"unsafe"
+	"io/ioutil"
+	"math"
+	"time"
 )
 
 // Node types
@@ -13,17 +18,61 @@ const (
 	kpnode
 )
 
+// Node header flags, stored in the high bits of ntype
+const (
+	nodeCompressed = 1 << 6
+	// Node is followed by a crc32 of its encoding
+	nodeChecksum = 1 << 5
+	nodeTypeMask = nodeChecksum - 1
+)
+
+var errNoChecksum = errors.New("Node has no checksum")
+
+// Values stored inline are limited to valueLenMask bytes, larger ones
+// need a blob threshold
+var ErrValueTooLarge = errors.New("Value too large to store inline")
+
 type Key []byte
 type Value []byte
 type DiskPos int64
 
+// kv flags, stored in the high bits of the encoded value length
+const (
+	kvBlob = 1 << 31
+	// Value is preceded by an int64 expiry time
+	kvExpires = 1 << 30
+	// Deleted key, the value holds the deletion time and sequence
+	kvTombstone  = 1 << 29
+	valueLenMask = kvTombstone - 1
+)
+
 type kv struct {
-	k Key
-	v Value
+	k     Key
+	v     Value
+	flags uint32
+	// Expiry time in unix nanoseconds, 0 if the item does not expire
+	expires int64
+	// Set on query results for keys that were not found
+	missing bool
+}
+
+// Clock used for expiry
+var timeNow = time.Now
+
+func (itm *kv) expired() bool {
+	return itm.expires != 0 && itm.expires <= timeNow().UnixNano()
+}
+
+func (itm *kv) tombstone() bool {
+	return itm.flags&kvTombstone != 0
 }
 
+// Length of the encoded item, see Bytes
 func (itm kv) Size() uint32 {
-	sz := unsafe.Sizeof(itm)
+	sz := 8 + len(itm.k) + len(itm.v)
+	if itm.expires != 0 {
+		sz += 8
+	}
 	return uint32(sz)
 }
 
@@ -32,24 +81,58 @@ func (itm *kv) Bytes() []byte {
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.LittleEndian, uint32(len(itm.k)))
 	buf.Write(itm.k)
-	binary.Write(buf, binary.LittleEndian, uint32(len(itm.v)))
+	flags := itm.flags
+	if itm.expires != 0 {
+		flags |= kvExpires
+	}
+	binary.Write(buf, binary.LittleEndian, uint32(len(itm.v))|flags)
+	if itm.expires != 0 {
+		binary.Write(buf, binary.LittleEndian, itm.expires)
+	}
 	buf.Write(itm.v)
 
 	return buf.Bytes()
 }
 
+// Lengths above this are not trusted for preallocation, since they
+// may come from a damaged file
+const maxPrealloc = 1 << 20
+
+// Read exactly l bytes
+func readBytes(r io.Reader, l uint32) ([]byte, error) {
+	if l <= maxPrealloc {
+		buf := make([]byte, l)
+		_, err := io.ReadFull(r, buf)
+		return buf, err
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(r, int64(l)))
+	if err == nil && uint32(len(buf)) != l {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf, err
+}
+
 // Read kv from file
 func (itm *kv) Read(r io.Reader) error {
 	var l uint32
-	var buf []byte
 
 	err := binary.Read(r, binary.LittleEndian, &l)
 	if err != nil {
 		return err
 	}
 
-	buf = make([]byte, l)
-	_, err = r.Read(buf)
+	// The stream may only end before an item
+	err = itm.readFields(r, l)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+func (itm *kv) readFields(r io.Reader, l uint32) error {
+	buf, err := readBytes(r, l)
 	if err != nil {
 		return err
 	}
@@ -61,12 +144,20 @@ func (itm *kv) Read(r io.Reader) error {
 		return err
 	}
 
-	buf = make([]byte, l)
-	_, err = r.Read(buf[:l])
+	itm.flags = l &^ valueLenMask &^ kvExpires
+	if l&kvExpires != 0 {
+		err = binary.Read(r, binary.LittleEndian, &itm.expires)
+		if err != nil {
+			return err
+		}
+	}
+
+	l &= valueLenMask
+	buf, err = readBytes(r, l)
 	if err != nil {
 		return err
 	}
-	itm.v = Value(buf[:l])
+	itm.v = Value(buf)
 
 	return nil
 }
@@ -78,58 +169,143 @@ type node struct {
 
 // Read from diskpos and parse node
 func (tree *btree) readNode(pos int64) (*node, error) {
+	return tree.readNodeChecked(pos, false)
+}
+
+// Read node and, if verify is set, check it against its checksum
+func (tree *btree) readNodeChecked(pos int64, verify bool) (*node, error) {
 	var l uint32
+	var f, r io.Reader
 	n := new(node)
 
-	tree.file.Seek(pos, 0)
-	err := binary.Read(tree.file, binary.LittleEndian, &n.ntype)
+	// Positional reads, so that readers don't disturb concurrent appends
+	disk := bufio.NewReader(io.NewSectionReader(tree.file, pos, math.MaxInt64-pos))
+	hash := crc32.NewIEEE()
+	f = disk
+	if verify {
+		f = io.TeeReader(disk, hash)
+	}
+
+	err := binary.Read(f, binary.LittleEndian, &n.ntype)
 	if err != nil {
 		return nil, err
 	}
-	err = binary.Read(tree.file, binary.LittleEndian, &l)
+	err = binary.Read(f, binary.LittleEndian, &l)
 	if err != nil {
 		return nil, err
 	}
 
+	flags := n.ntype
+	n.ntype &= nodeTypeMask
+	r = f
+	if flags&nodeCompressed != 0 {
+		r, err = tree.readCompressed(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	for i := 0; i < int(l); i++ {
 		itm := new(kv)
-		err = itm.Read(tree.file)
+		err = itm.Read(r)
 		if err != nil {
 			return nil, err
 		}
 		n.kvlist = append(n.kvlist, itm)
 	}
 
+	if verify {
+		var cksum uint32
+		if flags&nodeChecksum == 0 {
+			return n, errNoChecksum
+		}
+
+		err = binary.Read(disk, binary.LittleEndian, &cksum)
+		if err != nil {
+			return nil, err
+		}
+
+		if cksum != hash.Sum32() {
+			return n, errors.New("Node checksum mismatch")
+		}
+	}
+
 	return n, nil
 }
 
-// Write node to disk and return diskpos
-func (tree *btree) writeNode(n *node) (pos int64, err error) {
-	var written int
-	offset := tree.offset
-	pos = offset
-	tree.file.Seek(pos, 0)
+// Read compressed node payload and return a reader over decompressed kvs
+func (tree *btree) readCompressed(r io.Reader) (io.Reader, error) {
+	var l uint32
 
-	err = binary.Write(tree.file, binary.LittleEndian, n.ntype)
+	if tree.config.Codec == nil {
+		return nil, errors.New("Compressed node found, but no codec configured")
+	}
+
+	err := binary.Read(r, binary.LittleEndian, &l)
 	if err != nil {
-		return
+		return nil, err
 	}
-	err = binary.Write(tree.file, binary.LittleEndian, uint32(len(n.kvlist)))
+
+	buf, err := readBytes(r, l)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	offset += int64(5)
+	buf, err = tree.config.Codec.Decompress(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(buf), nil
+}
 
+// Write node to disk and return diskpos
+func (tree *btree) writeNode(n *node) (pos int64, err error) {
+	var written int
+	ntype := n.ntype | nodeChecksum
+	o := tree.owner()
+	pos = o.offset
+
+	payload := new(bytes.Buffer)
 	for i := 0; i < len(n.kvlist); i++ {
-		written, err = tree.file.Write(n.kvlist[i].Bytes())
+		payload.Write(n.kvlist[i].Bytes())
+	}
+	data := payload.Bytes()
+
+	// Keep compressed payload only if it saves space
+	if tree.config.Codec != nil {
+		var cdata []byte
+		cdata, err = tree.config.Codec.Compress(data)
 		if err != nil {
 			return
 		}
-		offset += int64(written)
+
+		o.stats.RawBytes += uint64(len(data))
+		if len(cdata)+4 < len(data) {
+			ntype |= nodeCompressed
+			data = cdata
+			o.stats.CompressedNodes++
+			o.stats.StoredBytes += uint64(len(cdata) + 4)
+		} else {
+			o.stats.StoredBytes += uint64(len(data))
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, ntype)
+	binary.Write(buf, binary.LittleEndian, uint32(len(n.kvlist)))
+	if ntype&nodeCompressed != 0 {
+		binary.Write(buf, binary.LittleEndian, uint32(len(data)))
+	}
+	buf.Write(data)
+	binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+
+	written, err = tree.file.WriteAt(buf.Bytes(), pos)
+	if err != nil {
+		return
 	}
 
-	tree.offset = offset
+	o.offset = pos + int64(written)
 	return
 }
 
@@ -1,7 +1,10 @@
 package btree
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
 )
 
@@ -52,3 +55,207 @@ func TestNodeReadWrite(t *testing.T) {
 		}
 	}
 }
+
+func TestNodeCompression(t *testing.T) {
+	var n node
+	tree := initTree()
+	tree.config.Codec = FlateCodec{Level: 6}
+	n.ntype = kvnode
+	for i := 0; i < 100; i++ {
+		itm := new(kv)
+		itm.k = Key(fmt.Sprintf("key_%d", i))
+		itm.v = Value(fmt.Sprintf(`{"id": %d, "name": "user", "active": true}`, i))
+		n.kvlist = append(n.kvlist, itm)
+	}
+
+	pos, err := tree.writeNode(&n)
+	if err != nil {
+		t.Fatalf("Failed to write node (%s)", err)
+	}
+
+	stats := tree.Stats()
+	if stats.CompressedNodes != 1 {
+		t.Fatalf("Expected node to be compressed (%d)", stats.CompressedNodes)
+	}
+
+	if stats.CompressionRatio() >= 1 {
+		t.Errorf("Unexpected compression ratio %f", stats.CompressionRatio())
+	}
+
+	m, err := tree.readNode(pos)
+	if err != nil {
+		t.Fatalf("Failed to read node (%s)", err)
+	}
+
+	if m.ntype != kvnode {
+		t.Errorf("Invalid node type (%d)", m.ntype)
+	}
+
+	if len(m.kvlist) != 100 {
+		t.Fatalf("Found different numbers of kvs in node (%d)", len(m.kvlist))
+	}
+
+	for i := 0; i < len(m.kvlist); i++ {
+		if !equals(*m.kvlist[i], *n.kvlist[i]) {
+			t.Fatalf("Found invalid kv - %s", string(m.kvlist[i].k))
+		}
+	}
+
+	tree.config.Codec = nil
+	_, err = tree.readNode(pos)
+	if err == nil {
+		t.Errorf("Expected error reading compressed node without codec")
+	}
+}
+
+type otherCodec struct {
+	FlateCodec
+}
+
+func (c otherCodec) Name() string {
+	return "other"
+}
+
+func TestCompressionRecorded(t *testing.T) {
+	os.Remove(TEST_FILE)
+	defer os.Remove(TEST_FILE)
+
+	// The zero value compresses
+	config := DefaultConfig()
+	config.Codec = FlateCodec{}
+	tree, err := Open(TEST_FILE, config)
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+	for i := 0; i < 1000; i++ {
+		tree.Insert(make_key(i), Value(fmt.Sprintf(`{"id": %d, "name": "user", "active": true}`, i)))
+	}
+	tree.Flush()
+	tree.Close()
+
+	// Statistics describe the file after reopen and compaction
+	tree, err = Open(TEST_FILE, config)
+	if err != nil {
+		t.Fatalf("Failed to reopen tree (%s)", err)
+	}
+	if r := tree.Stats().CompressionRatio(); r >= 1 {
+		t.Errorf("Expected compression ratio of the file after reopen, found %f", r)
+	}
+	tree.Compact()
+	if r := tree.Stats().CompressionRatio(); r >= 1 {
+		t.Errorf("Expected compression ratio of the file after compaction, found %f", r)
+	}
+	tree.Close()
+
+	config.Codec = otherCodec{}
+	_, err = Open(TEST_FILE, config)
+	if err == nil {
+		t.Errorf("Expected open with another codec to fail")
+	}
+}
+
+func TestBlobValues(t *testing.T) {
+	var n node
+	tree := initTree()
+	tree.config.BlobThreshold = 64
+	tree.cmp = func(k1, k2 *Key) int {
+		return bytes.Compare(*k1, *k2)
+	}
+
+	big := bytes.Repeat([]byte("x"), 1<<16)
+	for i := 0; i < 10; i++ {
+		itm := new(kv)
+		itm.k = Key(fmt.Sprintf("key_%d", i))
+		itm.v = Value(fmt.Sprintf("val_%d", i))
+		if i == 5 {
+			itm.v = Value(big)
+		}
+		n.kvlist = append(n.kvlist, itm)
+	}
+
+	err := tree.build(n.kvlist)
+	if err != nil {
+		t.Fatalf("Failed to build tree (%s)", err)
+	}
+
+	k := make_key(5)
+	received := []kv{}
+	qreq := &QueryRequest{
+		Keys: []*Key{&k},
+		Callback: func(itm kv) {
+			received = append(received, itm)
+		},
+	}
+
+	err = tree.query(qreq)
+	if err != nil {
+		t.Fatalf("query returned non-nil error (%s)", err)
+	}
+
+	if len(received) != 1 || !bytes.Equal(received[0].v, big) {
+		t.Fatalf("Unexpected value for blob key")
+	}
+
+	// Rewriting a leaf should not copy the blob again
+	sz := tree.offset
+	rq := &ModifyRequest{
+		ops: []Operation{
+			Operation{itm: kv{k: make_key(6), v: make_value(60)}, op: OP_INSERT},
+		},
+	}
+	err = tree.modify(rq)
+	if err != nil {
+		t.Fatalf("modify returned non-nil error (%s)", err)
+	}
+
+	if tree.offset-sz >= int64(len(big)) {
+		t.Errorf("Blob value was rewritten on modify")
+	}
+
+	r, err := tree.GetReader(k)
+	if err != nil {
+		t.Fatalf("GetReader failed (%s)", err)
+	}
+	defer r.Close()
+
+	buf, _ := ioutil.ReadAll(r)
+	if !bytes.Equal(buf, big) {
+		t.Errorf("Unexpected value from GetReader")
+	}
+
+	_, err = tree.GetReader(make_key(100))
+	if err == nil {
+		t.Errorf("Expected error for missing key")
+	}
+}
+
+func TestValueTooLarge(t *testing.T) {
+	tree := initTree()
+	tree.cmp, _ = lookupComparator(DEFAULT_COMPARATOR)
+	defer tree.Close()
+
+	// Pages of the value are never touched, only its length is checked
+	v := make(Value, valueLenMask+1)
+	_, err := tree.prepare(&kv{k: make_key(1), v: v})
+	if err != ErrValueTooLarge {
+		t.Errorf("Expected value too large error from prepare, got %v", err)
+	}
+
+	itm, err := tree.prepare(&kv{k: make_key(1), v: v[:valueLenMask]})
+	if err != nil || len(itm.v) != valueLenMask {
+		t.Errorf("Expected value at the inline limit to be kept inline (%v)", err)
+	}
+
+	err = tree.Insert(make_key(1), v)
+	if err != ErrValueTooLarge {
+		t.Errorf("Expected value too large error from Insert, got %v", err)
+	}
+	if _, err = tree.Get(make_key(1)); err != ErrNotFound {
+		t.Errorf("Expected rejected key to be absent (%v)", err)
+	}
+
+	err = tree.BulkLoad(&sliceIter{kvs: []kv{{k: make_key(1), v: v}}})
+	if err != ErrValueTooLarge {
+		t.Errorf("Expected value too large error from BulkLoad, got %v", err)
+	}
+}
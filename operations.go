@@ -1,10 +1,14 @@
 package btree
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
+	"strings"
 )
 
 type node_builder struct {
@@ -13,6 +17,8 @@ type node_builder struct {
 	pointers []*kv
 	values   []*kv
 	valsize  uint32
+	// Underfilled remainder of a rebuilt child, to be merged with a sibling
+	pending *node_builder
 }
 
 func new_node_builder(tree *btree, t int8) *node_builder {
@@ -76,6 +82,16 @@ func (b *node_builder) add(itm *kv) error {
 	return b.maybe_flush()
 }
 
+// Add a new item, moving large values out of line
+func (b *node_builder) add_new(itm *kv) error {
+	itm, err := b.tree.prepare(itm)
+	if err != nil {
+		return err
+	}
+
+	return b.add(itm)
+}
+
 // Add vals from one builder to another
 func (b *node_builder) add_vals(vals []*kv) error {
 	for _, itm := range vals {
@@ -88,31 +104,206 @@ func (b *node_builder) add_vals(vals []*kv) error {
 	return nil
 }
 
-// Reduce to single node by generating levels of nodes
+// Rebuilt nodes filled below this are merged with a sibling
+func (b node_builder) minFill() uint32 {
+	return b.chunkSize() / 2
+}
+
+// Builder for a rebuilt child, continuing a pending remainder if any
+func (b *node_builder) child_builder(ntype int8) *node_builder {
+	cb := b.pending
+	if cb == nil {
+		return new_node_builder(b.tree, ntype)
+	}
+
+	b.pending = nil
+	return cb
+}
+
+// Add nodes written by a child builder. An underfilled remainder is
+// kept pending, so that it gets merged with the next sibling.
+func (b *node_builder) add_child(cb *node_builder) error {
+	err := b.add_vals(cb.pointers)
+	if err != nil {
+		return err
+	}
+	cb.pointers = nil
+
+	if len(cb.values) > 0 && cb.valsize < cb.minFill() {
+		b.pending = cb
+		return nil
+	}
+
+	err = cb.finish()
+	if err != nil {
+		return err
+	}
+
+	return b.add_vals(cb.pointers)
+}
+
+// Add items of two merged siblings. Items that need more than one node
+// are split evenly in two, so that no underfilled remainder is left.
+func (b *node_builder) add_merged(vals []*kv) error {
+	var total uint32
+	for _, itm := range vals {
+		total += itm.Size()
+	}
+
+	for i, itm := range vals {
+		if total < b.chunkSize() || b.valsize < total/2 {
+			b.values = append(b.values, itm)
+			b.valsize += itm.Size()
+			continue
+		}
+
+		err := b.flush()
+		if err != nil {
+			return err
+		}
+
+		return b.add_vals(vals[i:])
+	}
+
+	return nil
+}
+
+// Add pointer to an unmodified child, merging it with a pending
+// remainder. The merged nodes are always written out, so that a merge
+// only rewrites a single sibling.
+func (b *node_builder) add_pointer(itm *kv) error {
+	if b.pending == nil {
+		return b.add(itm)
+	}
+
+	n, err := b.tree.readNode(v2p(itm.v))
+	if err != nil {
+		return err
+	}
+
+	cb := b.child_builder(n.ntype)
+	vals := append(cb.values, n.kvlist...)
+	cb.values, cb.valsize = nil, 0
+
+	err = cb.add_merged(vals)
+	if err == nil {
+		err = cb.finish()
+	}
+	if err != nil {
+		return err
+	}
+
+	return b.add_vals(cb.pointers)
+}
+
+// Write out a pending remainder, merged with its left sibling if that
+// is not written out yet
+func (b *node_builder) flush_pending() error {
+	cb := b.pending
+	if cb == nil {
+		return nil
+	}
+	b.pending = nil
+
+	if len(b.values) > 0 {
+		left := b.values[len(b.values)-1]
+		b.values = b.values[:len(b.values)-1]
+		b.valsize -= left.Size()
+
+		n, err := b.tree.readNode(v2p(left.v))
+		if err != nil {
+			return err
+		}
+
+		merged := new_node_builder(b.tree, n.ntype)
+		err = merged.add_merged(append(n.kvlist, cb.values...))
+		if err != nil {
+			return err
+		}
+		cb = merged
+	}
+
+	err := cb.finish()
+	if err != nil {
+		return err
+	}
+
+	return b.add_vals(cb.pointers)
+}
+
+// Reduce to single node by generating levels of nodes. The returned
+// root holds a single pointer to the top node, kpnode levels with a
+// single child are left out. Without any items, the root is nil.
 func build_root(nb *node_builder) (*node, error) {
-	root_builder := nb
-	nb.finish()
+	var top []*kv
+	tree := nb.tree
+
+	// Pointers added to a kpnode builder are nodes already
+	if nb.ntype == kpnode && len(nb.pointers) == 0 {
+		top = nb.values
+	} else {
+		err := nb.finish()
+		if err != nil {
+			return nil, err
+		}
+		top = nb.pointers
+	}
 
+	for len(top) > 1 {
+		tmp_builder := new_node_builder(tree, kpnode)
+		err := tmp_builder.add_vals(top)
+		if err == nil {
+			err = tmp_builder.finish()
+		}
+		if err != nil {
+			return nil, err
+		}
+		top = tmp_builder.pointers
+	}
+
+	// Empty tree
+	if len(top) == 0 {
+		return nil, nil
+	}
+
+	// Queries expect the top node to be a kpnode
 	for {
-		tmp_builder := new(node_builder)
-		tmp_builder.ntype = kpnode
-		tmp_builder.tree = nb.tree
+		n, err := tree.readNode(v2p(top[0].v))
+		if err != nil {
+			return nil, err
+		}
 
-		err := tmp_builder.add_vals(root_builder.pointers)
+		if n.ntype == kvnode {
+			tmp_builder := new_node_builder(tree, kpnode)
+			err = tmp_builder.add_vals(top)
+			if err == nil {
+				err = tmp_builder.finish()
+			}
+			if err != nil {
+				return nil, err
+			}
+			top = tmp_builder.pointers
+			break
+		}
+
+		if len(n.kvlist) != 1 {
+			break
+		}
+
+		child, err := tree.readNode(v2p(n.kvlist[0].v))
 		if err != nil {
 			return nil, err
 		}
 
-		tmp_builder.finish()
-		root_builder = tmp_builder
-		if len(root_builder.pointers) == 1 {
+		if child.ntype != kpnode {
 			break
 		}
+		top = n.kvlist
 	}
 
 	root := new(node)
 	root.ntype = kpnode
-	root.kvlist = append(root.kvlist, root_builder.pointers[0])
+	root.kvlist = append(root.kvlist, top[0])
 
 	return root, nil
 }
@@ -125,7 +316,7 @@ func (tree *btree) build(kvs []*kv) error {
 	nb.tree = tree
 
 	for _, itm := range kvs {
-		err := nb.add(itm)
+		err := nb.add_new(itm)
 		if err != nil {
 			return err
 		}
@@ -143,20 +334,63 @@ type QueryRequest struct {
 	Range        bool
 	rangeStarted bool
 	noaction     bool
+	// Return out of line values as blob pointers
+	raw bool
+	// Return tombstones of deleted keys
+	tombstones bool
+	// Set to end the query early
+	stop bool
+	// Optional context, checked before each node read
+	ctx context.Context
 	// Fetch callback
 	Callback func(itm kv)
 }
 
+// Pass a found item to the query callback, loading out of line values
+func (tree *btree) found(rq *QueryRequest, itm *kv) error {
+	// Expired items and tombstones are hidden until compaction drops
+	// them
+	if itm.expired() || itm.tombstone() && !rq.tombstones {
+		if !rq.Range {
+			rq.Callback(kv{k: itm.k, v: Value(""), missing: true})
+		}
+		return nil
+	}
+
+	if itm.flags&kvBlob != 0 && !rq.raw {
+		v, err := tree.readBlob(itm.v)
+		if err != nil {
+			return err
+		}
+		itm = &kv{k: itm.k, v: v, expires: itm.expires}
+	}
+
+	rq.Callback(*itm)
+	return nil
+}
+
 // Query api
 func (tree *btree) query(rq *QueryRequest) error {
 	if tree.root == nil {
-		return errors.New("Empty root")
+		for i := 0; !rq.Range && i < len(rq.Keys); i++ {
+			rq.Callback(kv{k: *rq.Keys[i], v: Value(""), missing: true})
+		}
+		return nil
 	}
 
 	return tree.query_node(rq, v2p(tree.root.kvlist[0].v), 0, len(rq.Keys))
 }
 
 func (tree *btree) query_node(rq *QueryRequest, diskPos int64, start, end int) error {
+	if rq.stop {
+		return nil
+	}
+
+	err := ctxErr(rq.ctx)
+	if err != nil {
+		return err
+	}
+
 	n, err := tree.readNode(diskPos)
 	if err != nil {
 		return err
@@ -208,7 +442,7 @@ func (tree *btree) query_node(rq *QueryRequest, diskPos int64, start, end int) e
 		}
 
 		for !rq.Range && start < end {
-			not_found := kv{*rq.Keys[start], Value("")}
+			not_found := kv{k: *rq.Keys[start], v: Value(""), missing: true}
 			rq.Callback(not_found)
 			start++
 		}
@@ -216,7 +450,7 @@ func (tree *btree) query_node(rq *QueryRequest, diskPos int64, start, end int) e
 
 	// Search for given list of keys in kvnode
 	if n.ntype == kvnode {
-		for i := 0; (rq.rangeStarted || start < end) && i < max; i++ {
+		for i := 0; !rq.stop && (rq.rangeStarted || start < end) && i < max; i++ {
 			cmpkey := n.kvlist[i]
 			cmpval := 0
 			switch {
@@ -230,7 +464,7 @@ func (tree *btree) query_node(rq *QueryRequest, diskPos int64, start, end int) e
 			case !rq.noaction && cmpval > 0:
 				switch {
 				case !rq.Range:
-					not_found := kv{*rq.Keys[start], Value("")}
+					not_found := kv{k: *rq.Keys[start], v: Value(""), missing: true}
 					rq.Callback(not_found)
 					break
 				default:
@@ -241,14 +475,14 @@ func (tree *btree) query_node(rq *QueryRequest, diskPos int64, start, end int) e
 							break
 						default:
 							rq.rangeStarted = true
-							rq.Callback(*cmpkey)
+							err = tree.found(rq, cmpkey)
 						}
 					}
 				}
 				start++
 				break
 			case !rq.noaction && cmpval == 0:
-				rq.Callback(*cmpkey)
+				err = tree.found(rq, cmpkey)
 				start++
 				if rq.Range {
 					switch {
@@ -262,9 +496,13 @@ func (tree *btree) query_node(rq *QueryRequest, diskPos int64, start, end int) e
 				break
 
 			case rq.rangeStarted:
-				rq.Callback(*cmpkey)
+				err = tree.found(rq, cmpkey)
 				break
 			}
+
+			if err != nil {
+				return err
+			}
 		}
 	}
 
@@ -274,35 +512,183 @@ func (tree *btree) query_node(rq *QueryRequest, diskPos int64, start, end int) e
 const (
 	OP_INSERT = iota
 	OP_DELETE
+	// Conditional operations, evaluated against the current value
+	OP_CAS
+	OP_PUT_IF_ABSENT
+	OP_DELETE_IF_EQUALS
+	// Combine operands with the current value
+	OP_MERGE
 )
 
 type Operation struct {
 	itm kv
 	op  int
+	// Value required by OP_CAS and OP_DELETE_IF_EQUALS
+	expected Value
+	// Merge function and operands of OP_MERGE
+	merge    func(Key, Value, Value) Value
+	operands []Value
+	// Set by modify if the key was present before, and if the
+	// operation changed the tree
+	found   bool
+	applied bool
+	// Sequence number assigned if changes are tracked
+	seq uint64
+}
+
+func (op *Operation) deletes() bool {
+	return op.op == OP_DELETE || op.op == OP_DELETE_IF_EQUALS
 }
 
 type ModifyRequest struct {
 	ops []Operation
+	// Optional context, checked before each node read
+	ctx context.Context
+}
+
+// Error of a done context, nil for no context
+func ctxErr(ctx context.Context) error {
+	if ctx == nil {
+		return nil
+	}
+
+	return ctx.Err()
 }
 
 func (tree *btree) modify(rq *ModifyRequest) error {
+	// Sequence numbers are assigned as operations are applied
+	_, err := tree.seq_tree()
+	if err != nil {
+		return err
+	}
+
+	if tree.root == nil {
+		return tree.modify_empty(rq)
+	}
+
 	root_builder := new_node_builder(tree, kpnode)
-	err := tree.modify_node(rq, root_builder, v2p(tree.root.kvlist[0].v), 0, len(rq.ops))
+	err = tree.modify_node(rq, root_builder, v2p(tree.root.kvlist[0].v), 0, len(rq.ops))
+	if err == nil {
+		err = root_builder.flush_pending()
+	}
 	if err != nil {
 		return err
 	}
 
 	tree.root, err = build_root(root_builder)
-	return err
+	if err != nil {
+		return err
+	}
+
+	tree.queue_events(rq)
+	return tree.record_changes(rq)
+}
+
+// Grow an empty tree from the inserts of a modify request
+func (tree *btree) modify_empty(rq *ModifyRequest) error {
+	var err error
+	nb := new_node_builder(tree, kvnode)
+
+	for i := range rq.ops {
+		err = tree.apply_op(nb, &rq.ops[i], nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	tree.root, err = build_root(nb)
+	if err != nil {
+		return err
+	}
+
+	tree.queue_events(rq)
+	return tree.record_changes(rq)
+}
+
+// Apply an operation to the leaf being rebuilt, cur is the current
+// item for the key or nil if it is absent
+func (tree *btree) apply_op(nb *node_builder, op *Operation, cur *kv) error {
+	var err error
+	// An expired item is absent, and dropped unless replaced. A
+	// tombstone is absent, but kept unless replaced.
+	var tomb *kv
+	if cur != nil && cur.tombstone() {
+		tomb = cur
+	}
+	if cur != nil && (cur.expired() || tomb != nil) {
+		cur = nil
+	}
+	op.found = cur != nil
+
+	switch op.op {
+	case OP_INSERT:
+		op.applied = true
+	case OP_DELETE:
+		op.applied = cur != nil
+	case OP_PUT_IF_ABSENT:
+		op.applied = cur == nil
+	case OP_CAS, OP_DELETE_IF_EQUALS:
+		var v Value
+		if cur != nil {
+			v, err = tree.resolve(cur)
+			if err != nil {
+				return err
+			}
+			op.applied = bytes.Equal(v, op.expected)
+		}
+		// A swapped value keeps the expiry of the one it replaces
+		if op.applied && op.op == OP_CAS && op.itm.expires == 0 {
+			op.itm.expires = cur.expires
+		}
+	case OP_MERGE:
+		var v Value
+		if cur != nil {
+			v, err = tree.resolve(cur)
+			if err != nil {
+				return err
+			}
+			op.itm.expires = cur.expires
+		}
+		for _, operand := range op.operands {
+			v = op.merge(op.itm.k, v, operand)
+		}
+		op.itm.v = v
+		op.applied = true
+	}
+
+	if op.applied && tree.byseq != nil {
+		tree.seq++
+		op.seq = tree.seq
+	}
+
+	switch {
+	case op.applied && op.deletes() && tree.config.Tombstones:
+		return nb.add(newTombstone(op.itm.k, op.seq))
+	case op.applied && op.deletes():
+		return nil
+	case op.applied:
+		return nb.add_new(&op.itm)
+	case cur != nil:
+		return nb.add(cur)
+	case tomb != nil:
+		return nb.add(tomb)
+	}
+
+	return nil
 }
 
 func (tree *btree) modify_node(rq *ModifyRequest, nb *node_builder, diskPos int64, start, end int) error {
+	err := ctxErr(rq.ctx)
+	if err != nil {
+		return err
+	}
+
 	n, err := tree.readNode(diskPos)
 	if err != nil {
 		return err
 	}
 
-	cnb := new_node_builder(tree, n.ntype)
+	cnb := nb.child_builder(n.ntype)
 
 	max := len(n.kvlist)
 	i := 0
@@ -311,17 +697,22 @@ func (tree *btree) modify_node(rq *ModifyRequest, nb *node_builder, diskPos int6
 		for ; start < end && i < max; i++ {
 			cmpkey := n.kvlist[i].k
 			cmpval := tree.cmp(&cmpkey, &rq.ops[start].itm.k)
+			// Last child takes all remaining ops
 			if i == max-1 {
 				err = tree.modify_node(rq, cnb, v2p(n.kvlist[i].v), start, end)
 				if err != nil {
 					return err
 				}
-				break
+				start = end
+				continue
 			}
 
 			switch {
 			case cmpval < 0:
-				cnb.add(n.kvlist[i])
+				err = cnb.add_pointer(n.kvlist[i])
+				if err != nil {
+					return err
+				}
 			case cmpval >= 0:
 				range_end := start
 				for range_end < end && tree.cmp(&cmpkey, &rq.ops[range_end].itm.k) >= 0 {
@@ -336,8 +727,16 @@ func (tree *btree) modify_node(rq *ModifyRequest, nb *node_builder, diskPos int6
 			}
 		}
 
-		for i++; i < max; i++ {
-			cnb.add(n.kvlist[i])
+		for ; i < max; i++ {
+			err = cnb.add_pointer(n.kvlist[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		err = cnb.flush_pending()
+		if err != nil {
+			return err
 		}
 	}
 
@@ -348,22 +747,19 @@ func (tree *btree) modify_node(rq *ModifyRequest, nb *node_builder, diskPos int6
 			cmpval := tree.cmp(&cmpkey, &op.itm.k)
 			switch {
 			case cmpval < 0:
-				cnb.add(n.kvlist[i])
+				err = cnb.add(n.kvlist[i])
 				i++
-				break
 			case cmpval > 0:
-				if op.op == OP_INSERT {
-					cnb.add(&op.itm)
-				}
+				err = tree.apply_op(cnb, &rq.ops[start], nil)
 				start++
-				break
 			case cmpval == 0:
-				if op.op == OP_INSERT {
-					cnb.add(&op.itm)
-				}
+				err = tree.apply_op(cnb, &rq.ops[start], n.kvlist[i])
 				start++
 				i++
-				break
+			}
+
+			if err != nil {
+				return err
 			}
 		}
 
@@ -372,81 +768,288 @@ func (tree *btree) modify_node(rq *ModifyRequest, nb *node_builder, diskPos int6
 		}
 
 		for ; start < end; start++ {
-			op := rq.ops[start]
-			if op.op == OP_INSERT {
-				cnb.add(&op.itm)
+			err = tree.apply_op(cnb, &rq.ops[start], nil)
+			if err != nil {
+				return err
 			}
 		}
 	}
 
-	cnb.finish()
-	nb.add_vals(cnb.pointers)
-
-	return err
+	return nb.add_child(cnb)
 }
 
 func (tree *btree) write_header() error {
 	var err error
-	if tree.root == nil {
-		return errors.New("Btree root is empty")
+	if tree.parent != nil {
+		return tree.parent.write_header()
+	}
+
+	h := header{
+		version:       FORMAT_VERSION,
+		kvChunkSize:   tree.config.kvChunkSize,
+		kpChunkSize:   tree.config.kpChunkSize,
+		blobThreshold: tree.config.BlobThreshold,
+		cmp:           tree.cmpName,
+		features:      FEATURE_NODE_CHECKSUMS,
+	}
+	if tree.config.Codec != nil {
+		h.features |= FEATURE_COMPRESSION | FEATURE_CODEC
+		h.codec = tree.config.Codec.Name()
+	}
+	if tree.config.BlobThreshold > 0 {
+		h.features |= FEATURE_BLOBS
+	}
+	if tree.expiring {
+		h.features |= FEATURE_EXPIRY
+	}
+	if tree.config.Tombstones {
+		h.features |= FEATURE_TOMBSTONES
+	}
+	if tree.generation != 0 {
+		h.features |= FEATURE_GENERATION
+		h.generation = tree.generation
+	}
+	names := tree.tree_names(true)
+	for _, name := range names {
+		h.trees = append(h.trees, catalogEntry{name: name, cmp: tree.trees[name].cmpName})
+		h.features |= FEATURE_CATALOG
+	}
+	tree.seqs = tree.seq_marks()
+	for name, seq := range tree.seqs {
+		h.seqs = append(h.seqs, seqMark{name: name, seq: seq})
+		h.features |= FEATURE_SEQUENCES
 	}
-	var h header
-	h.rootptr, err = tree.writeNode(tree.root)
+	sort.Slice(h.seqs, func(i, j int) bool {
+		return h.seqs[i].name < h.seqs[j].name
+	})
+
+	// Root pointers have a fixed size, so the header can be checked
+	// before any root is written
+	err = h.check()
 	if err != nil {
-		errors.New("Unable to write root node")
+		return err
+	}
+
+	h.rootptr = EMPTY_ROOT
+	if tree.root != nil {
+		h.rootptr, err = tree.writeNode(tree.root)
+		if err != nil {
+			return errors.New("Unable to write root node")
+		}
+	}
+
+	for i, name := range names {
+		child := tree.trees[name]
+		h.trees[i].rootptr = EMPTY_ROOT
+		if child.root != nil {
+			h.trees[i].rootptr, err = tree.writeNode(child.root)
+			if err != nil {
+				return errors.New("Unable to write root node")
+			}
+		}
 	}
 
+	// Statistics include the root nodes just written
+	h.stats = tree.stats
+
 	headerpos := tree.offset + (BLOCK_SIZE - (tree.offset % BLOCK_SIZE))
-	tree.file.Seek(headerpos, 0)
-	n, err := tree.file.Write(h.Bytes())
+	n, err := tree.file.WriteAt(h.Bytes(), headerpos)
 	if err != nil {
 		return err
 	}
 
 	tree.offset = headerpos + int64(n)
+	version := Version{tree.generation, headerpos}
+	tree.set_committed(version, tree.offset)
+
+	tree.publish(version)
+	for _, child := range tree.trees {
+		child.publish(version)
+	}
 
 	return nil
 }
 
+// Scan backwards from pos for the closest parseable header
+func (tree *btree) find_header(pos int64) (*header, int64, error) {
+	h := new(header)
+	buf := make([]byte, BLOCK_SIZE)
+
+	for pos >= 0 {
+		pos -= pos % BLOCK_SIZE
+		n, _ := tree.file.ReadAt(buf, pos)
+		err := h.Parse(buf[:n])
+		if err == errShortHeader && n == len(buf) {
+			large := make([]byte, MAX_HEADER_SIZE)
+			n, _ = tree.file.ReadAt(large, pos)
+			err = h.Parse(large[:n])
+		}
+
+		if err == nil {
+			return h, pos, nil
+		}
+
+		pos--
+	}
+
+	return nil, -1, errors.New("Btree header not found")
+}
+
 func (tree *btree) read_header() error {
+	return tree.load_header(false)
+}
+
+// Load latest header and root. Legacy headers are only accepted
+// when upgrading.
+func (tree *btree) load_header(legacy bool) error {
 	var err error
-	var pos int64
-	var h header
-	buf := make([]byte, HEADER_SIZE)
 	tree.offset, err = tree.file.Seek(0, 2)
 	if err != nil {
 		return err
 	}
 
-	pos = tree.offset
-	for {
-		diff := pos % BLOCK_SIZE
-		pos := pos - diff
-		tree.file.Seek(pos, 0)
-		tree.file.Read(buf[0:HEADER_SIZE])
-		err = h.Parse(buf)
-		var root *node
-		if err == nil {
-			root, err = tree.readNode(h.rootptr)
+	h, pos, err := tree.find_header(tree.offset)
+	if err != nil {
+		return err
+	}
+
+	// Statistics of the nodes written up to the header
+	tree.stats = h.stats
+	tree.generation = h.generation
+	tree.seqs = make(map[string]uint64)
+	for _, m := range h.seqs {
+		tree.seqs[m.name] = m.seq
+	}
+
+	return tree.apply_header(h, pos, legacy)
+}
+
+// Adopt the roots and settings of the header at pos
+func (tree *btree) apply_header(h *header, pos int64, legacy bool) error {
+	var err error
+
+	switch {
+	case h.version > FORMAT_VERSION:
+		return ErrUnsupportedVersion
+	case h.version < FORMAT_VERSION && !legacy:
+		return ErrUpgradeRequired
+	case h.features&^FEATURES_KNOWN != 0:
+		return errors.New("Unsupported btree feature flags")
+	case h.features&FEATURE_COMPRESSION != 0 && tree.config.Codec == nil:
+		return errors.New("Btree file has compressed nodes, but no codec configured")
+	case h.codec != "" && tree.config.Codec.Name() != h.codec:
+		return errors.New("Codec mismatch: file uses " + h.codec +
+			", configured " + tree.config.Codec.Name())
+	}
+
+	if h.features&FEATURE_EXPIRY != 0 {
+		tree.expiring = true
+	}
+	if h.features&FEATURE_TOMBSTONES != 0 {
+		tree.config.Tombstones = true
+	}
+
+	// Keep the node sizes and blob threshold the file was written with
+	if h.kvChunkSize != 0 {
+		tree.config.kvChunkSize = h.kvChunkSize
+		tree.config.kpChunkSize = h.kpChunkSize
+	}
+	if tree.config.BlobThreshold == 0 {
+		tree.config.BlobThreshold = h.blobThreshold
+	}
+
+	tree.root = nil
+	if h.rootptr != EMPTY_ROOT {
+		tree.root, err = tree.readNode(h.rootptr)
+		if err != nil {
+			return err
+		}
+	}
+	// The ordering of headers written before comparators were recorded
+	// is unknown, they need an explicit Config.Comparator
+	tree.cmpName = h.cmp
+	if tree.cmpName == "" {
+		tree.cmpName = UNREGISTERED_COMPARATOR
+	}
+
+	// Named trees, existing handles are kept up to date
+	trees := make(map[string]*btree)
+	for _, e := range h.trees {
+		child := tree.trees[e.name]
+		if child == nil {
+			child = &btree{
+				file:    tree.file,
+				config:  tree.config,
+				parent:  tree,
+				name:    e.name,
+				cmpName: e.cmp,
+			}
+			if e.cmp == "" {
+				child.cmpName = UNREGISTERED_COMPARATOR
+			}
+		}
+
+		child.root = nil
+		if e.rootptr != EMPTY_ROOT {
+			child.root, err = tree.readNode(e.rootptr)
 			if err != nil {
 				return err
 			}
-			tree.root = root
-			break
 		}
+		trees[e.name] = child
+	}
+	tree.trees = trees
+	tree.set_committed(Version{tree.generation, pos}, pos+int64(len(h.Bytes())))
 
-		pos--
+	return nil
+}
 
-		if pos < 0 {
-			return errors.New("Btree header not found")
-		}
+// Copy all items, or those accepted by keep if set, into the file of
+// ntree and return the new root
+func (tree *btree) copy_to(ctx context.Context, ntree *btree, keep func(*kv) bool) (*node, error) {
+	var err error
+	nb := new_node_builder(ntree, kvnode)
+
+	var allquery *QueryRequest
+	allquery = &QueryRequest{
+		Keys: []*Key{nil, nil},
+		Callback: func(itm kv) {
+			if err != nil || keep != nil && !keep(&itm) {
+				return
+			}
+
+			err = nb.add_new(&itm)
+			if err != nil {
+				allquery.stop = true
+			}
+		},
+		Range:      true,
+		tombstones: true,
+		ctx:        ctx,
 	}
 
-	return nil
+	qerr := tree.query(allquery)
+	if err == nil {
+		err = qerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return build_root(nb)
 }
 
 func (tree *btree) compact() error {
-	var nb node_builder
+	return tree.compact_ctx(context.Background())
+}
+
+// Rewrite live items of all trees into a new file, which replaces the
+// current one. If ctx is done first, the new file is removed and
+// ctx.Err() returned.
+func (tree *btree) compact_ctx(ctx context.Context) error {
+	if tree.parent != nil {
+		return tree.parent.compact_ctx(ctx)
+	}
 
 	fn := tree.file.Name()
 	dir := path.Dir(fn)
@@ -455,51 +1058,73 @@ func (tree *btree) compact() error {
 		return err
 	}
 
-	ch := make(chan kv)
-
-	allquery := &QueryRequest{
-		Keys: []*Key{nil, nil},
-		Callback: func(itm kv) {
-			ch <- itm
-		},
-		Range: true,
-	}
-
-	go func() {
-		tree.query(allquery)
-		close(ch)
-	}()
-
-	ntree := new(btree)
-	*ntree = *tree
-	ntree.offset = 0
-	ntree.file = tmpfile
-	nb.ntype = kvnode
-	nb.tree = ntree
-
-	for itm := range ch {
-		err := nb.add(&itm)
-		if err != nil {
-			return err
-		}
+	ntree := &btree{
+		file:    tmpfile,
+		config:  tree.config,
+		cmp:     tree.cmp,
+		cmpName: tree.cmpName,
 	}
 
-	nb.finish()
-	tree.root, err = build_root(&nb)
+	roots, err := tree.copy_all(ctx, ntree)
 	if err != nil {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
 		return err
 	}
 
+	tree.root = roots[""]
 	tree.file.Close()
 	ntree.file.Close()
 	os.Remove(fn)
 	os.Rename(tmpfile.Name(), fn)
-	tree.file, err = os.OpenFile(fn, os.O_RDWR, os.ModePerm)
+	f, err := os.OpenFile(fn, os.O_RDWR, os.ModePerm)
 	if err != nil {
 		return err
 	}
 
+	// Shipping reads the file concurrently, nothing is committed in the
+	// new one until its header is written
+	tree.commitLock.Lock()
+	tree.file = f
+	tree.commit, tree.commitEnd = Version{}, 0
+	tree.commitLock.Unlock()
+
+	tree.generation = new_generation()
 	tree.offset = ntree.offset
+	tree.stats = ntree.stats
+	for name, child := range tree.trees {
+		child.root = roots[name]
+		child.file = tree.file
+	}
 
 	return err
 }
+
+// Copy the default tree and all named trees into ntree, the new roots
+// are keyed by tree name
+func (tree *btree) copy_all(ctx context.Context, ntree *btree) (map[string]*node, error) {
+	var err error
+	roots := make(map[string]*node)
+
+	roots[""], err = tree.copy_to(ctx, ntree, tree.purge_filter())
+	if err != nil {
+		return nil, err
+	}
+
+	for name, child := range tree.trees {
+		keep := child.purge_filter()
+		if strings.HasPrefix(name, SEQ_TREE) {
+			keep, err = child.latest_changes()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		roots[name], err = child.copy_to(ctx, ntree, keep)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return roots, nil
+}
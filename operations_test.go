@@ -86,7 +86,7 @@ func TestSimpleTreeLookup(t *testing.T) {
 	}
 
 	for i := 0; i < len(vals); i++ {
-		if !equals(received[i], kv{*keys[i], vals[i]}) {
+		if !equals(received[i], kv{k: *keys[i], v: vals[i]}) {
 			t.Errorf("received %s/%s - expected %s/%s\n",
 				string(received[i].k),
 				string(received[i].v),
@@ -149,7 +149,7 @@ func TestSimpleTreeRangeLookup(t *testing.T) {
 
 	for i := 0; i <= 20; i++ {
 		offset := i + 40
-		itm := kv{make_key(offset), make_value(offset)}
+		itm := kv{k: make_key(offset), v: make_value(offset)}
 		if !equals(itm, received[i]) {
 			t.Errorf("Unexpected key received, %s for %s", string(itm.k), string(received[i].k))
 		}
@@ -157,7 +157,7 @@ func TestSimpleTreeRangeLookup(t *testing.T) {
 
 	for i := 21; i <= 21+15; i++ {
 		offset := i + 59
-		itm := kv{make_key(offset), make_value(offset)}
+		itm := kv{k: make_key(offset), v: make_value(offset)}
 		if !equals(itm, received[i]) {
 			t.Errorf("Unexpected key received, %s for %s", string(itm.k), string(received[i].k))
 		}
@@ -213,7 +213,7 @@ func TestSimpleTreeRangeLookup2(t *testing.T) {
 	}
 
 	for i := 0; i <= 100; i++ {
-		itm := kv{make_key(i), make_value(i)}
+		itm := kv{k: make_key(i), v: make_value(i)}
 		if !equals(itm, received[i]) {
 			t.Errorf("Unexpected key received, %s for %s", string(itm.k), string(received[i].k))
 		}
@@ -221,7 +221,7 @@ func TestSimpleTreeRangeLookup2(t *testing.T) {
 
 	for i := 101; i <= 101+99; i++ {
 		offset := i + 799
-		itm := kv{make_key(offset), make_value(offset)}
+		itm := kv{k: make_key(offset), v: make_value(offset)}
 		if !equals(itm, received[i]) {
 			t.Errorf("Unexpected key received, %s for %s", string(itm.k), string(received[i].k))
 		}
@@ -271,7 +271,7 @@ func TestSimpleTreeFullLookup(t *testing.T) {
 	}
 
 	for i := 0; i < 1000; i++ {
-		itm := kv{make_key(i), make_value(i)}
+		itm := kv{k: make_key(i), v: make_value(i)}
 		if !equals(itm, received[i]) {
 			t.Errorf("Unexpected key received, %s for %s", string(itm.k), string(received[i].k))
 		}
@@ -308,10 +308,10 @@ func TestSimpleTreeModify(t *testing.T) {
 
 	rq := &ModifyRequest{
 		ops: []Operation{
-			Operation{itm: kv{make_key(4), make_value(4)}, op: OP_DELETE},
-			Operation{itm: kv{make_key(9), make_value(9)}, op: OP_INSERT},
-			Operation{itm: kv{make_key(12), make_value(100)}, op: OP_INSERT},
-			Operation{itm: kv{make_key(25), make_value(25)}, op: OP_INSERT},
+			Operation{itm: kv{k: make_key(4), v: make_value(4)}, op: OP_DELETE},
+			Operation{itm: kv{k: make_key(9), v: make_value(9)}, op: OP_INSERT},
+			Operation{itm: kv{k: make_key(12), v: make_value(100)}, op: OP_INSERT},
+			Operation{itm: kv{k: make_key(25), v: make_value(25)}, op: OP_INSERT},
 		},
 	}
 
@@ -360,19 +360,19 @@ func TestSimpleTreeModify(t *testing.T) {
 	if len(received) != 4 {
 		t.Error("Unexpected count after modification")
 	}
-	if !equals(received[0], kv{k1, Value("")}) {
-		t.Errorf("Deleted key found", string(received[0].v))
+	if !equals(received[0], kv{k: k1, v: Value("")}) {
+		t.Errorf("Deleted key found %s", string(received[0].v))
 	}
 
-	if !equals(received[1], kv{k2, make_value(9)}) {
+	if !equals(received[1], kv{k: k2, v: make_value(9)}) {
 		t.Errorf("Error inserted key with unexpected val")
 	}
 
-	if !equals(received[2], kv{k3, make_value(100)}) {
+	if !equals(received[2], kv{k: k3, v: make_value(100)}) {
 		t.Errorf("Error inserted key with unexpected val")
 	}
 
-	if !equals(received[3], kv{k4, make_value(25)}) {
+	if !equals(received[3], kv{k: k4, v: make_value(25)}) {
 		t.Errorf("Error inserted key with unexpected val")
 	}
 
@@ -443,7 +443,7 @@ func TestCompaction(t *testing.T) {
 	for i := 0; i < 100; i++ {
 		rq := &ModifyRequest{
 			ops: []Operation{
-				Operation{itm: kv{make_key(5), make_value(0)}, op: OP_INSERT},
+				Operation{itm: kv{k: make_key(5), v: make_value(0)}, op: OP_INSERT},
 			},
 		}
 		err := tree.modify(rq)
@@ -464,3 +464,304 @@ func TestCompaction(t *testing.T) {
 		t.Fatalf("Compaction sizes doesn't match %d >= %d", Sz2, Sz1)
 	}
 }
+
+// Count leaves filled below half of the chunk size
+func countUnderfilled(tree *btree, pos int64) int {
+	n, _ := tree.readNode(pos)
+	if n.ntype == kvnode {
+		var sz uint32
+		for _, itm := range n.kvlist {
+			sz += itm.Size()
+		}
+		if sz < tree.config.kvChunkSize/2 {
+			return 1
+		}
+		return 0
+	}
+
+	count := 0
+	for _, itm := range n.kvlist {
+		count += countUnderfilled(tree, v2p(itm.v))
+	}
+	return count
+}
+
+func TestDeleteMerge(t *testing.T) {
+	N := 2000
+	tree := initTree()
+	tree.cmp = func(k1, k2 *Key) int {
+		return compareKeyIds(*k1, *k2)
+	}
+
+	var kvs []*kv
+	for i := 0; i < N; i++ {
+		kvs = append(kvs, &kv{k: make_key(i), v: make_value(i)})
+	}
+	tree.build(kvs)
+	tree.write_header()
+
+	info, _ := tree.Info()
+	depth := info.Depth
+
+	// Delete 9 out of every 10 keys, in several batches
+	for batch := 0; batch < 10; batch++ {
+		rq := &ModifyRequest{}
+		for i := batch * N / 10; i < (batch+1)*N/10; i++ {
+			if i%10 != 0 {
+				rq.ops = append(rq.ops, Operation{itm: kv{k: make_key(i)}, op: OP_DELETE})
+			}
+		}
+
+		err := tree.modify(rq)
+		if err != nil {
+			t.Fatalf("modify returned non-nil error (%s)", err)
+		}
+	}
+	tree.write_header()
+
+	info, _ = tree.Info()
+	if info.Items != N/10 {
+		t.Fatalf("Expected %d items, found %d", N/10, info.Items)
+	}
+
+	if info.Depth > depth {
+		t.Errorf("Depth grew from %d to %d", depth, info.Depth)
+	}
+
+	underfilled := countUnderfilled(tree, v2p(tree.root.kvlist[0].v))
+	if underfilled > 1 {
+		t.Errorf("Found %d underfilled leaves out of %d", underfilled, info.KVNodes)
+	}
+
+	report, _ := tree.Verify(VerifyOptions{})
+	if !report.Ok() {
+		t.Errorf("Unexpected violations %v", report.Violations)
+	}
+
+	// Repeated modifications must not add levels
+	for i := 0; i < 20; i++ {
+		rq := &ModifyRequest{
+			ops: []Operation{Operation{itm: kv{k: make_key(5), v: make_value(5)}, op: OP_INSERT}},
+		}
+		tree.modify(rq)
+	}
+	tree.write_header()
+
+	info2, _ := tree.Info()
+	if info2.Depth != info.Depth {
+		t.Errorf("Depth changed from %d to %d", info.Depth, info2.Depth)
+	}
+}
+
+func TestDeleteMergeWrites(t *testing.T) {
+	N := 5000
+	tree := initTree()
+	tree.config.kvChunkSize = DEFAULT_KV_CHUNKSIZE
+	tree.config.kpChunkSize = DEFAULT_KP_CHUNKSIZE
+	tree.cmp = func(k1, k2 *Key) int {
+		return compareKeyIds(*k1, *k2)
+	}
+
+	var kvs []*kv
+	for i := 0; i < N; i++ {
+		kvs = append(kvs, &kv{k: make_key(i), v: make_value(i)})
+	}
+	tree.build(kvs)
+	tree.write_header()
+
+	remove := func(from, to int) int64 {
+		rq := &ModifyRequest{}
+		for i := from; i < to; i++ {
+			rq.ops = append(rq.ops, Operation{itm: kv{k: make_key(i)}, op: OP_DELETE})
+		}
+
+		offset := tree.offset
+		err := tree.modify(rq)
+		if err != nil {
+			t.Fatalf("modify returned non-nil error (%s)", err)
+		}
+		return tree.offset - offset
+	}
+
+	normal := remove(0, 1)
+
+	// Underflow the first leaf, which is merged with its right sibling
+	first, _ := tree.readNode(v2p(tree.root.kvlist[0].v))
+	for first.ntype == kpnode {
+		first, _ = tree.readNode(v2p(first.kvlist[0].v))
+	}
+	merged := remove(1, len(first.kvlist))
+
+	if merged > 3*normal {
+		t.Errorf("Expected a merge to rewrite a single sibling, wrote %d bytes for %d of a delete", merged, normal)
+	}
+
+	report, _ := tree.Verify(VerifyOptions{})
+	if !report.Ok() {
+		t.Errorf("Unexpected violations %v", report.Violations)
+	}
+}
+
+func TestEmptyTree(t *testing.T) {
+	tree := initTree()
+	tree.cmp = func(k1, k2 *Key) int {
+		return compareKeyIds(*k1, *k2)
+	}
+
+	// Queries on a fresh tree
+	k := make_key(1)
+	received := []kv{}
+	qreq := &QueryRequest{
+		Keys: []*Key{&k},
+		Callback: func(itm kv) {
+			received = append(received, itm)
+		},
+	}
+	err := tree.query(qreq)
+	if err != nil || len(received) != 1 || !received[0].missing {
+		t.Fatalf("Unexpected point query result on empty tree %v (%v)", received, err)
+	}
+
+	received = []kv{}
+	qreq.Keys = []*Key{nil, nil}
+	qreq.Range = true
+	err = tree.query(qreq)
+	if err != nil || len(received) != 0 {
+		t.Fatalf("Unexpected range query result on empty tree %v (%v)", received, err)
+	}
+
+	// Empty tree is persisted
+	err = tree.write_header()
+	if err != nil {
+		t.Fatalf("Failed header write (%s)", err)
+	}
+
+	tree2 := openTree()
+	err = tree2.read_header()
+	if err != nil || tree2.root != nil {
+		t.Fatalf("Expected empty root after reopen (%v)", err)
+	}
+
+	// Grow from empty
+	rq := &ModifyRequest{
+		ops: []Operation{
+			Operation{itm: kv{k: make_key(1), v: make_value(1)}, op: OP_INSERT},
+			Operation{itm: kv{k: make_key(2), v: make_value(2)}, op: OP_DELETE},
+			Operation{itm: kv{k: make_key(3), v: make_value(3)}, op: OP_INSERT},
+		},
+	}
+	err = tree.modify(rq)
+	if err != nil || tree.root == nil {
+		t.Fatalf("Failed to insert into empty tree (%v)", err)
+	}
+
+	received = []kv{}
+	tree.query(qreq)
+	if len(received) != 2 {
+		t.Fatalf("Expected 2 items, found %d", len(received))
+	}
+
+	// Shrink back to empty
+	rq = &ModifyRequest{
+		ops: []Operation{
+			Operation{itm: kv{k: make_key(1)}, op: OP_DELETE},
+			Operation{itm: kv{k: make_key(3)}, op: OP_DELETE},
+		},
+	}
+	err = tree.modify(rq)
+	if err != nil || tree.root != nil {
+		t.Fatalf("Expected empty tree after deleting all keys (%v)", err)
+	}
+
+	tree.write_header()
+	tree2 = openTree()
+	err = tree2.read_header()
+	if err != nil || tree2.root != nil {
+		t.Fatalf("Expected empty root after reopen (%v)", err)
+	}
+
+	report, _ := tree.Verify(VerifyOptions{})
+	if !report.Ok() || report.Items != 0 {
+		t.Errorf("Unexpected verify report for empty tree %+v", report)
+	}
+
+	// Empty bulk load and build
+	err = tree.BulkLoad(new(sliceIter))
+	if err != nil || tree.root != nil {
+		t.Errorf("Expected empty tree after empty bulk load (%v)", err)
+	}
+
+	err = tree.build(nil)
+	if err != nil || tree.root != nil {
+		t.Errorf("Expected empty tree after empty build (%v)", err)
+	}
+}
+
+func TestConditionalOps(t *testing.T) {
+	tree := initTree()
+	tree.config.BlobThreshold = 16
+	tree.cmp = func(k1, k2 *Key) int {
+		return compareKeyIds(*k1, *k2)
+	}
+
+	big := Value("a value stored out of line as a blob")
+	rq := &ModifyRequest{}
+	for i := 0; i < 100; i++ {
+		rq.ops = append(rq.ops, Operation{itm: kv{k: make_key(i), v: make_value(i)}, op: OP_INSERT})
+	}
+	rq.ops[50].itm.v = big
+	err := tree.modify(rq)
+	if err != nil {
+		t.Fatalf("Failed to build tree (%s)", err)
+	}
+
+	rq = &ModifyRequest{
+		ops: []Operation{
+			Operation{itm: kv{k: make_key(10), v: Value("x")}, op: OP_CAS, expected: make_value(10)},
+			Operation{itm: kv{k: make_key(11), v: Value("x")}, op: OP_CAS, expected: make_value(12)},
+			Operation{itm: kv{k: make_key(12), v: Value("x")}, op: OP_PUT_IF_ABSENT},
+			Operation{itm: kv{k: make_key(13)}, op: OP_DELETE_IF_EQUALS, expected: make_value(13)},
+			Operation{itm: kv{k: make_key(14)}, op: OP_DELETE_IF_EQUALS, expected: make_value(15)},
+			Operation{itm: kv{k: make_key(50), v: Value("x")}, op: OP_CAS, expected: big},
+			Operation{itm: kv{k: make_key(150), v: Value("x")}, op: OP_CAS},
+			Operation{itm: kv{k: make_key(151), v: Value("x")}, op: OP_PUT_IF_ABSENT},
+		},
+	}
+	err = tree.modify(rq)
+	if err != nil {
+		t.Fatalf("Modify failed (%s)", err)
+	}
+
+	expected := []bool{true, false, false, true, false, true, false, true}
+	for i, op := range rq.ops {
+		if op.applied != expected[i] {
+			t.Errorf("Expected applied %v for %s, found %v", expected[i], op.itm.k, op.applied)
+		}
+	}
+
+	values := map[int]string{10: "x", 11: "val_11", 12: "val_12", 14: "val_14", 50: "x", 151: "x"}
+	for id, v := range values {
+		found, err := tree.Get(make_key(id))
+		if err != nil || string(found) != v {
+			t.Errorf("Expected %s for %s, found %s (%v)", v, make_key(id), found, err)
+		}
+	}
+	for _, id := range []int{13, 150} {
+		if _, err := tree.Get(make_key(id)); err != ErrNotFound {
+			t.Errorf("Expected %s to be absent (%v)", make_key(id), err)
+		}
+	}
+
+	ok, err := tree.PutIfAbsent(make_key(10), Value("y"))
+	if ok || err != nil {
+		t.Errorf("Expected PutIfAbsent on present key to fail (%v)", err)
+	}
+	ok, err = tree.CompareAndSwap(make_key(10), Value("x"), Value("y"))
+	if !ok || err != nil {
+		t.Errorf("Expected CompareAndSwap to succeed (%v)", err)
+	}
+	ok, err = tree.DeleteIfEquals(make_key(10), Value("y"))
+	if !ok || err != nil {
+		t.Errorf("Expected DeleteIfEquals to succeed (%v)", err)
+	}
+}
@@ -0,0 +1,306 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+)
+
+// Log shipping frames carry a byte range of the leader file that ends
+// with a committed header. Each frame is
+//
+//	magic, flags uint32, start int64, length int64, generation uint64,
+//	version int64, bytes
+//
+// where version is the offset of the header within the range and
+// generation the generation of the leader file.
+const REPL_MAGIC = "GBTL"
+
+// Frame flags
+const (
+	// Range starts a new copy of the file, the follower discards its own
+	REPL_RESET = 1 << iota
+)
+
+var errBadFrame = errors.New("Invalid replication frame")
+
+type frame struct {
+	flags      uint32
+	start      int64
+	length     int64
+	generation uint64
+	version    int64
+}
+
+func (tree *btree) set_committed(version Version, end int64) {
+	tree.commitLock.Lock()
+	tree.commit, tree.commitEnd = version, end
+	tree.commitLock.Unlock()
+}
+
+// Latest committed version, the end of its header and the file holding
+// it, compaction replaces the file
+func (tree *btree) committed() (Version, int64, *os.File) {
+	tree.commitLock.Lock()
+	defer tree.commitLock.Unlock()
+	return tree.commit, tree.commitEnd, tree.file
+}
+
+// Write the bytes appended since version, up to the latest committed
+// header, as one frame and return the version shipped. The zero
+// Version ships the whole file, as does a version of another
+// generation or one that does not name a header of the file. If nothing
+// was committed since version, an empty frame is written.
+func (tree *btree) Ship(w io.Writer, since Version) (Version, error) {
+	o := tree.owner()
+	cur, end, file := o.committed()
+	if end == 0 {
+		return since, errors.New("Btree has no committed version")
+	}
+
+	f := frame{length: end, generation: cur.Generation, version: cur.Offset}
+	switch {
+	case since == Version{}:
+	case since.Generation != cur.Generation || since.Offset > cur.Offset:
+		f.flags = REPL_RESET
+	case since.Offset == cur.Offset:
+		f.start, f.length = since.Offset, 0
+	default:
+		view := &btree{file: file}
+		_, hpos, err := view.find_header(since.Offset)
+		if err != nil || hpos != since.Offset {
+			f.flags = REPL_RESET
+		} else {
+			f.start, f.length = since.Offset, end-since.Offset
+		}
+	}
+
+	buf := make([]byte, 0, 40)
+	buf = append(buf, REPL_MAGIC...)
+	buf = binary.LittleEndian.AppendUint32(buf, f.flags)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(f.start))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(f.length))
+	buf = binary.LittleEndian.AppendUint64(buf, f.generation)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(f.version))
+	_, err := w.Write(buf)
+	if err != nil {
+		return since, err
+	}
+
+	_, err = io.Copy(w, io.NewSectionReader(file, f.start, f.length))
+	if err != nil {
+		return since, err
+	}
+
+	return Version{f.generation, f.version}, nil
+}
+
+// Answer version requests of a follower with frames until the
+// connection is closed
+func (tree *btree) ServeReplica(rw io.ReadWriter) error {
+	var since Version
+
+	for {
+		err := binary.Read(rw, binary.LittleEndian, &since)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = tree.Ship(rw, since)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Read only mirror of a leader file, updated from shipped frames.
+// Readers see the latest applied version.
+type Follower struct {
+	tree    *btree
+	lock    sync.RWMutex
+	version Version
+}
+
+func OpenFollower(filename string, config Config) (*Follower, error) {
+	tree, err := open_file(filename, config)
+	if err != nil {
+		return nil, err
+	}
+
+	version, _, _ := tree.committed()
+	return &Follower{tree: tree, version: version}, nil
+}
+
+// Latest applied version of the leader file
+func (f *Follower) Version() Version {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.version
+}
+
+// Apply one frame. The new header is validated before its root is
+// published to readers.
+func (f *Follower) Apply(r io.Reader) error {
+	buf := make([]byte, len(REPL_MAGIC)+36)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return err
+	}
+	if string(buf[:len(REPL_MAGIC)]) != REPL_MAGIC {
+		return errBadFrame
+	}
+
+	buf = buf[len(REPL_MAGIC):]
+	fr := frame{
+		flags:      binary.LittleEndian.Uint32(buf),
+		start:      int64(binary.LittleEndian.Uint64(buf[4:])),
+		length:     int64(binary.LittleEndian.Uint64(buf[12:])),
+		generation: binary.LittleEndian.Uint64(buf[20:]),
+		version:    int64(binary.LittleEndian.Uint64(buf[28:])),
+	}
+
+	tree := f.tree
+	_, end, _ := tree.committed()
+	switch {
+	case fr.length == 0:
+		return nil
+	case fr.length < 0 || fr.version < fr.start || fr.version >= fr.start+fr.length:
+		return errBadFrame
+	case fr.flags&REPL_RESET == 0 && fr.start > end:
+		return errors.New("Replication frame leaves a gap")
+	case fr.flags&REPL_RESET == 0 && fr.start > 0 && fr.generation != f.Version().Generation:
+		return errors.New("Replication frame is from another generation of the file")
+	}
+
+	if fr.flags&REPL_RESET != 0 {
+		return f.reset(fr, r)
+	}
+
+	// Bytes are appended beyond the applied version, so readers are
+	// only held off while the new header is loaded
+	err = copy_frame(tree.file, fr, r)
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	err = tree.file.Truncate(fr.start + fr.length)
+	if err == nil {
+		err = load_frame(tree, fr)
+	}
+	if err != nil {
+		return err
+	}
+
+	f.version = Version{fr.generation, fr.version}
+	return nil
+}
+
+// Write the bytes of a frame at their offset in file
+func copy_frame(file *os.File, fr frame, r io.Reader) error {
+	n, err := io.Copy(io.NewOffsetWriter(file, fr.start), io.LimitReader(r, fr.length))
+	if err == nil && n != fr.length {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// Load the header a frame ends with
+func load_frame(tree *btree, fr frame) error {
+	err := tree.load_header(false)
+	if err == nil && tree.commit != (Version{fr.generation, fr.version}) {
+		err = errors.New("Replicated header not found")
+	}
+	if err == nil {
+		tree.cmp, err = lookupComparator(tree.cmpName)
+	}
+
+	return err
+}
+
+// Replace the whole file by a frame. The frame is written to a temp
+// file, which is synced and checked before it is renamed over the
+// current one, so a failed reset leaves the applied version in place.
+func (f *Follower) reset(fr frame, r io.Reader) error {
+	tree := f.tree
+	fn := tree.file.Name()
+	tmpfile, err := ioutil.TempFile(path.Dir(fn), "replica")
+	if err != nil {
+		return err
+	}
+
+	ntree := &btree{file: tmpfile, config: tree.config}
+	err = copy_frame(tmpfile, fr, r)
+	if err == nil {
+		err = tmpfile.Sync()
+	}
+	if err == nil {
+		err = load_frame(ntree, fr)
+	}
+	if err != nil {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	err = os.Rename(tmpfile.Name(), fn)
+	if err != nil {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
+		return err
+	}
+
+	tree.file.Close()
+	tree.file = tmpfile
+	for _, child := range tree.trees {
+		child.file = tmpfile
+	}
+
+	err = load_frame(tree, fr)
+	if err != nil {
+		return err
+	}
+
+	f.version = Version{fr.generation, fr.version}
+	return nil
+}
+
+// Request the frames after the applied version from a leader and
+// apply them
+func (f *Follower) Sync(rw io.ReadWriter) error {
+	err := binary.Write(rw, binary.LittleEndian, f.Version())
+	if err != nil {
+		return err
+	}
+
+	return f.Apply(rw)
+}
+
+func (f *Follower) Get(k Key) (Value, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.tree.Get(k)
+}
+
+func (f *Follower) Scan(start, end Key, fn func(Key, Value) bool) error {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.tree.Scan(start, end, fn)
+}
+
+func (f *Follower) Close() error {
+	return f.tree.Close()
+}
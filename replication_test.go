@@ -0,0 +1,235 @@
+package btree
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const FOLLOWER_FILE = "follower.tree"
+
+func TestReplication(t *testing.T) {
+	os.Remove(TEST_FILE)
+	os.Remove(FOLLOWER_FILE)
+	defer os.Remove(TEST_FILE)
+	defer os.Remove(FOLLOWER_FILE)
+
+	tree, err := Open(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+	defer tree.Close()
+
+	follower, err := OpenFollower(FOLLOWER_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open follower (%s)", err)
+	}
+	defer follower.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen (%s)", err)
+	}
+	defer l.Close()
+
+	served := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			err = tree.ServeReplica(conn)
+			conn.Close()
+		}
+		served <- err
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect (%s)", err)
+	}
+
+	check := func(n int) {
+		err := follower.Sync(conn)
+		if err != nil {
+			t.Fatalf("Sync failed (%s)", err)
+		}
+
+		count := 0
+		follower.Scan(nil, nil, func(k Key, v Value) bool {
+			count++
+			return true
+		})
+		if count != n {
+			t.Errorf("Expected %d items on follower, found %d", n, count)
+		}
+
+		versions, _ := tree.Versions()
+		if follower.Version() != versions[0] {
+			t.Errorf("Expected follower at %d, found %d", versions[0], follower.Version())
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		tree.Insert(make_key(i), make_value(i))
+	}
+	tree.Flush()
+	check(100)
+
+	// Uncommitted changes are not shipped
+	tree.Remove(make_key(0))
+	check(100)
+
+	tree.Flush()
+	check(99)
+	check(99)
+
+	v, err := follower.Get(make_key(5))
+	if err != nil || string(v) != string(make_value(5)) {
+		t.Errorf("Unexpected value on follower %s (%v)", v, err)
+	}
+
+	// A compacted leader is shipped from the start
+	tree.Insert(make_key(200), make_value(200))
+	tree.Compact()
+	check(100)
+
+	conn.Close()
+	err = <-served
+	if err != nil {
+		t.Errorf("Serving replica failed (%s)", err)
+	}
+}
+
+func TestReplicationResetFailure(t *testing.T) {
+	os.Remove(TEST_FILE)
+	os.Remove(FOLLOWER_FILE)
+	defer os.Remove(TEST_FILE)
+	defer os.Remove(FOLLOWER_FILE)
+
+	tree, err := Open(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+	defer tree.Close()
+
+	follower, err := OpenFollower(FOLLOWER_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open follower (%s)", err)
+	}
+	defer func() { follower.Close() }()
+
+	count := func() int {
+		n := 0
+		follower.Scan(nil, nil, func(k Key, v Value) bool {
+			n++
+			return true
+		})
+		return n
+	}
+
+	for i := 0; i < 100; i++ {
+		tree.Insert(make_key(i), make_value(i))
+	}
+	tree.Flush()
+
+	buf := new(bytes.Buffer)
+	tree.Ship(buf, follower.Version())
+	err = follower.Apply(buf)
+	if err != nil {
+		t.Fatalf("Apply failed (%s)", err)
+	}
+
+	// Compaction makes the next frame a reset
+	tree.Remove(make_key(0))
+	tree.Compact()
+	buf.Reset()
+	tree.Ship(buf, follower.Version())
+
+	b := buf.Bytes()
+	err = follower.Apply(bytes.NewReader(b[:len(b)-10]))
+	if err == nil {
+		t.Errorf("Expected error applying a truncated reset frame")
+	}
+	if n := count(); n != 100 {
+		t.Errorf("Expected previous 100 items after failed reset, found %d", n)
+	}
+
+	tmpfiles, _ := filepath.Glob("replica[0-9]*")
+	if len(tmpfiles) != 0 {
+		t.Errorf("Temp files left behind %v", tmpfiles)
+	}
+
+	err = follower.Apply(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("Apply failed (%s)", err)
+	}
+	if n := count(); n != 99 {
+		t.Errorf("Expected 99 items after reset, found %d", n)
+	}
+
+	// The renamed file holds the new version
+	follower.Close()
+	follower, err = OpenFollower(FOLLOWER_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to reopen follower (%s)", err)
+	}
+	if n := count(); n != 99 {
+		t.Errorf("Expected 99 items after reopening, found %d", n)
+	}
+}
+
+func TestReplicationCompactedOffsets(t *testing.T) {
+	os.Remove(TEST_FILE)
+	os.Remove(FOLLOWER_FILE)
+	defer os.Remove(TEST_FILE)
+	defer os.Remove(FOLLOWER_FILE)
+
+	tree, err := Open(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+	defer tree.Close()
+
+	follower, err := OpenFollower(FOLLOWER_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open follower (%s)", err)
+	}
+	defer follower.Close()
+
+	sync := func() {
+		buf := new(bytes.Buffer)
+		_, err := tree.Ship(buf, follower.Version())
+		if err == nil {
+			err = follower.Apply(buf)
+		}
+		if err != nil {
+			t.Fatalf("Failed to replicate (%s)", err)
+		}
+	}
+
+	tree.Insert(Key("a"), Value("a"))
+	tree.Flush()
+	sync()
+	before := follower.Version()
+
+	// The compacted file commits at the offset the follower holds
+	tree.Remove(Key("a"))
+	tree.Insert(Key("b"), Value("b"))
+	tree.Compact()
+	info, _ := tree.Info()
+	if info.Version.Offset != before.Offset || info.Version == before {
+		t.Fatalf("Expected a new generation at offset %d, found %v", before.Offset, info.Version)
+	}
+
+	sync()
+	if follower.Version() != info.Version {
+		t.Errorf("Expected follower at %v, found %v", info.Version, follower.Version())
+	}
+	if _, err := follower.Get(Key("a")); err != ErrNotFound {
+		t.Errorf("Expected removed key to be gone from the follower (%v)", err)
+	}
+	if v, err := follower.Get(Key("b")); err != nil || string(v) != "b" {
+		t.Errorf("Expected key of the compacted file on the follower, found %s (%v)", string(v), err)
+	}
+}
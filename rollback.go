@@ -0,0 +1,153 @@
+package btree
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrVersionNotFound = errors.New("Version not found")
+
+// Revert all trees of the file to a committed version. By default a
+// new header pointing at the old roots is written, keeping later
+// versions in the history. With truncate the file is cut after the
+// header of version instead and a new generation of it starts.
+// Uncommitted modifications are dropped.
+func (tree *btree) RollbackTo(version Version, truncate bool) error {
+	o := tree.owner()
+
+	h, err := o.find_version(version)
+	if err != nil {
+		return err
+	}
+	pos := version.Offset
+
+	if truncate {
+		marks := o.seq_marks()
+		err = o.file.Truncate(pos + int64(len(h.Bytes())))
+		if err != nil {
+			return err
+		}
+
+		err = o.load_header(false)
+		if err != nil {
+			return err
+		}
+		o.reset_rollback()
+
+		// Later commits reuse the offsets of the discarded versions,
+		// which the new generation tells apart. Their sequence numbers
+		// are not reused.
+		o.generation = new_generation()
+		o.seqs = marks
+		return o.write_header()
+	}
+
+	cur, curPos, err := o.find_header(o.offset)
+	if err != nil {
+		return err
+	}
+
+	err = o.apply_header(h, pos, false)
+	if err != nil {
+		return err
+	}
+
+	// Sequence numbers continue from the latest index, where the keys
+	// that are reverted are recorded as new changes
+	for _, e := range cur.trees {
+		// Indexes of trees that are gone with the rollback are dropped
+		base := strings.TrimPrefix(strings.TrimPrefix(e.name, SEQ_TREE), "/")
+		if !strings.HasPrefix(e.name, RESERVED_PREFIX) || base != "" && o.trees[base] == nil {
+			continue
+		}
+
+		s, err := o.named(e.name, e.cmp)
+		if err != nil {
+			return err
+		}
+
+		s.root = nil
+		if e.rootptr != EMPTY_ROOT {
+			s.root, err = o.readNode(e.rootptr)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	o.reset_rollback()
+
+	for _, t := range o.all_trees() {
+		err = t.record_rollback(Version{o.generation, curPos}, version)
+		if err != nil {
+			return err
+		}
+	}
+
+	return o.write_header()
+}
+
+// Header of a committed version of the file
+func (tree *btree) find_version(version Version) (*header, error) {
+	h, pos, err := tree.find_header(version.Offset)
+	if err != nil || pos != version.Offset || h.version != FORMAT_VERSION ||
+		version.Generation != tree.generation {
+		return nil, ErrVersionNotFound
+	}
+
+	return h, nil
+}
+
+// Trees of the file other than internal ones
+func (tree *btree) all_trees() []*btree {
+	trees := []*btree{tree}
+	for _, name := range tree.tree_names(false) {
+		trees = append(trees, tree.trees[name])
+	}
+
+	return trees
+}
+
+// Reload sequence numbers after the index was replaced. Watchers can
+// not be told which keys changed.
+func (tree *btree) reset_rollback() {
+	trees := []*btree{tree}
+	for _, child := range tree.trees {
+		trees = append(trees, child)
+	}
+
+	for _, t := range trees {
+		t.byseq = nil
+		t.seq = 0
+		t.watchLock.Lock()
+		t.events = nil
+		t.watchLock.Unlock()
+		t.resync_watchers()
+	}
+}
+
+// Record keys that differ between the latest version and the one
+// rolled back to as changes, if they are tracked
+func (tree *btree) record_rollback(latest, version Version) error {
+	s, err := tree.seq_tree()
+	if s == nil || err != nil {
+		return err
+	}
+
+	rq := &ModifyRequest{}
+	err = tree.Diff(latest, version, func(e DiffEntry) bool {
+		op := Operation{itm: kv{k: e.Key}, op: OP_INSERT, applied: true}
+		if e.Type == DIFF_REMOVED {
+			op.op = OP_DELETE
+		}
+
+		tree.seq++
+		op.seq = tree.seq
+		rq.ops = append(rq.ops, op)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	return tree.record_changes(rq)
+}
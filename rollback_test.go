@@ -0,0 +1,165 @@
+package btree
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestRollback(t *testing.T) {
+	os.Remove(TEST_FILE)
+	defer os.Remove(TEST_FILE)
+
+	config := DefaultConfig()
+	config.TrackChanges = true
+	tree, err := Open(TEST_FILE, config)
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+	defer tree.Close()
+
+	for i := 0; i < 10; i++ {
+		tree.Insert(make_key(i), make_value(i))
+	}
+	tree.Flush()
+	versions, _ := tree.Versions()
+	good := versions[0]
+
+	for i := 0; i < 10; i++ {
+		tree.Remove(make_key(i))
+	}
+	tree.Flush()
+	tree.Insert(make_key(20), make_value(20))
+
+	err = tree.RollbackTo(Version{good.Generation, good.Offset + 1}, false)
+	if err != ErrVersionNotFound {
+		t.Errorf("Expected version not found (%v)", err)
+	}
+
+	err = tree.RollbackTo(good, false)
+	if err != nil {
+		t.Fatalf("Rollback failed (%s)", err)
+	}
+
+	check := func(nversions int, lastSeq uint64) {
+		info, _ := tree.Info()
+		if info.Items != 10 {
+			t.Errorf("Expected 10 items after rollback, found %d", info.Items)
+		}
+		if _, err := tree.Get(make_key(20)); err != ErrNotFound {
+			t.Errorf("Expected uncommitted key to be dropped (%v)", err)
+		}
+		if seq, _ := tree.LastSeq(); seq != lastSeq {
+			t.Errorf("Expected last sequence %d, found %d", lastSeq, seq)
+		}
+
+		versions, _ := tree.Versions()
+		if len(versions) != nversions {
+			t.Errorf("Expected %d versions, found %d", nversions, len(versions))
+		}
+	}
+	// Reverted keys are recorded after the 10 inserts and 10 removes
+	check(3, 30)
+
+	var changes []Change
+	tree.Changes(20, func(c Change) bool {
+		changes = append(changes, c)
+		return true
+	})
+	if len(changes) != 10 || changes[0].Seq != 21 || changes[0].Deleted {
+		t.Errorf("Expected 10 inserts recorded from sequence 21, found %v", changes)
+	}
+
+	info, _ := tree.Info()
+	latest := info.Version
+
+	err = tree.RollbackTo(good, true)
+	if err != nil {
+		t.Fatalf("Rollback with truncate failed (%s)", err)
+	}
+	// Truncation discards later changes as well, but not their
+	// sequence numbers
+	check(2, 30)
+
+	versions, _ = tree.Versions()
+	if versions[1].Offset != good.Offset || versions[0].Generation == good.Generation {
+		t.Errorf("Expected a new generation after %v, found %v", good, versions)
+	}
+	if info, _ = tree.Info(); info.FileSize >= latest.Offset {
+		t.Errorf("Expected data up to %d to be discarded, file size %d", latest.Offset, info.FileSize)
+	}
+
+	// The numbers are kept across reopening
+	tree.Close()
+	tree, err = Open(TEST_FILE, config)
+	if err != nil {
+		t.Fatalf("Failed to reopen tree (%s)", err)
+	}
+	defer tree.Close()
+
+	tree.Insert(make_key(20), make_value(20))
+	tree.Flush()
+	changes = nil
+	tree.Changes(10, func(c Change) bool {
+		changes = append(changes, c)
+		return true
+	})
+	if len(changes) != 1 || changes[0].Seq != 31 {
+		t.Errorf("Expected one change with sequence 31 after truncation, found %v", changes)
+	}
+}
+
+func TestRollbackReplicated(t *testing.T) {
+	os.Remove(TEST_FILE)
+	os.Remove(FOLLOWER_FILE)
+	defer os.Remove(TEST_FILE)
+	defer os.Remove(FOLLOWER_FILE)
+
+	tree, err := Open(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+	defer tree.Close()
+
+	follower, err := OpenFollower(FOLLOWER_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open follower (%s)", err)
+	}
+	defer follower.Close()
+
+	sync := func() {
+		var buf bytes.Buffer
+		_, err := tree.Ship(&buf, follower.Version())
+		if err == nil {
+			err = follower.Apply(&buf)
+		}
+		if err != nil {
+			t.Fatalf("Failed to replicate (%s)", err)
+		}
+	}
+
+	tree.Insert(Key("a"), Value("a"))
+	tree.Flush()
+	sync()
+	base := follower.Version()
+
+	tree.Insert(Key("b"), Value("b"))
+	tree.Flush()
+	sync()
+
+	// The follower holds a version that is discarded
+	err = tree.RollbackTo(base, true)
+	if err != nil {
+		t.Fatalf("Rollback with truncate failed (%s)", err)
+	}
+	tree.Insert(Key("c"), Value("c"))
+	tree.Flush()
+	sync()
+
+	if _, err := follower.Get(Key("b")); err != ErrNotFound {
+		t.Errorf("Expected discarded key to be gone from the follower (%v)", err)
+	}
+	if v, err := follower.Get(Key("c")); err != nil || string(v) != "c" {
+		t.Errorf("Expected key committed after rollback on the follower, found %s (%v)", v, err)
+	}
+}
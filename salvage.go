@@ -0,0 +1,444 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const SALVAGE_CHUNK = 1 << 20
+
+type SalvageReport struct {
+	// Readable kvnodes found in the damaged file and salvaged
+	NodesFound int
+	// Readable kvnodes of internal trees, which are not salvaged
+	NodesDropped int
+	// Keys written to the new file
+	KeysRecovered int
+	// Keys dropped because their out of line value was unreadable
+	ValuesLost int
+	Comparator string
+	// Named trees written to the new file, sorted
+	Trees []string
+}
+
+// Item found by salvage, the offset of the node holding it and its
+// salvage rank. Items of higher rank win, then those at higher offsets.
+type salvaged struct {
+	itm  *kv
+	pos  int64
+	rank int
+}
+
+// Salvage ranks of nodes
+const (
+	// Reached by older headers only, or by none
+	rankOld = iota
+	// Reached by the newest readable header
+	rankCurrent
+	// Written after the newest readable header
+	rankNewer
+)
+
+// Kvnode found by salvage that no readable header reaches
+type strayNode struct {
+	pos int64
+	nd  *node
+}
+
+// Map kvnodes reachable from any readable header to the name of the
+// tree they belong to, and named trees to their comparators. Kvnodes
+// reachable from the newest readable header, at offset latest, are
+// also marked current.
+func (old *btree) salvage_owners(size int64) (owners map[int64]string, current map[int64]bool,
+	latest int64, cmps map[string]string) {
+	owners = make(map[int64]string)
+	current = make(map[int64]bool)
+	cmps = make(map[string]string)
+	visited := make(map[int64]bool)
+	latest = -1
+
+	var walk func(pos, limit int64, name string, cur bool)
+	walk = func(pos, limit int64, name string, cur bool) {
+		if pos < 0 || pos >= limit || visited[pos] {
+			return
+		}
+		visited[pos] = true
+
+		nd, err := old.readNodeChecked(pos, true)
+		if nd == nil || err != nil && err != errNoChecksum {
+			return
+		}
+
+		if nd.ntype == kvnode {
+			owners[pos] = name
+			current[pos] = cur
+			return
+		}
+
+		for _, itm := range nd.kvlist {
+			walk(v2p(itm.v), pos, name, cur)
+		}
+	}
+
+	pos := size
+	for {
+		h, hpos, err := old.find_header(pos)
+		if err != nil {
+			break
+		}
+		if latest < 0 {
+			latest = hpos
+		}
+
+		if h.rootptr != EMPTY_ROOT {
+			walk(h.rootptr, hpos, "", hpos == latest)
+		}
+		for _, e := range h.trees {
+			if _, ok := cmps[e.name]; !ok {
+				cmps[e.name] = e.cmp
+			}
+			if e.rootptr != EMPTY_ROOT {
+				walk(e.rootptr, hpos, e.name, hpos == latest)
+			}
+		}
+
+		pos = hpos - 1
+	}
+
+	return owners, current, latest, cmps
+}
+
+// Chunk of the damaged file being scanned by salvage, reads outside
+// of it go to the file
+type salvageChunk struct {
+	f    *os.File
+	buf  []byte
+	base int64
+	n    int
+}
+
+func (c *salvageChunk) load(at int64) {
+	c.base = at
+	c.n, _ = c.f.ReadAt(c.buf, at)
+}
+
+func (c *salvageChunk) read(pos int64, b []byte) bool {
+	if pos >= c.base && pos+int64(len(b)) <= c.base+int64(c.n) {
+		copy(b, c.buf[pos-c.base:])
+		return true
+	}
+
+	n, _ := c.f.ReadAt(b, pos)
+	return n == len(b)
+}
+
+func (c *salvageChunk) uint32At(pos int64) (uint32, bool) {
+	var b [4]byte
+	ok := c.read(pos, b[:])
+	return binary.LittleEndian.Uint32(b[:]), ok
+}
+
+// Encoded length, including the checksum, of a node candidate at pos
+// whose item and payload lengths end within size, or 0
+func (c *salvageChunk) nodeLength(pos, size int64, flags byte) int64 {
+	count, ok := c.uint32At(pos + 1)
+	if !ok || count == 0 || int64(count) > (size-pos)/8 {
+		return 0
+	}
+
+	l := int64(5)
+	if flags&nodeCompressed != 0 {
+		pl, ok := c.uint32At(pos + 5)
+		if !ok {
+			return 0
+		}
+		l = 9 + int64(pl)
+	} else {
+		for ; count > 0 && pos+l <= size; count-- {
+			kl, ok := c.uint32At(pos + l)
+			if !ok {
+				return 0
+			}
+			l += 4 + int64(kl)
+
+			vl, ok := c.uint32At(pos + l)
+			if !ok {
+				return 0
+			}
+			l += 4 + int64(vl&valueLenMask)
+			if vl&kvExpires != 0 {
+				l += 8
+			}
+		}
+	}
+
+	if flags&nodeChecksum != 0 {
+		l += 4
+	}
+	if pos+l > size {
+		return 0
+	}
+	return l
+}
+
+// Whether the checksum of the l byte node at pos matches
+func (c *salvageChunk) checksum(pos, l int64) bool {
+	hash := crc32.NewIEEE()
+	if pos >= c.base && pos+l <= c.base+int64(c.n) {
+		hash.Write(c.buf[pos-c.base : pos-c.base+l-4])
+	} else if _, err := io.Copy(hash, io.NewSectionReader(c.f, pos, l-4)); err != nil {
+		return false
+	}
+
+	cksum, ok := c.uint32At(pos + l - 4)
+	return ok && cksum == hash.Sum32()
+}
+
+// Rebuild a tree from the kvnodes that survive in a damaged file and
+// write it to a new file at dst. Each key keeps its version reachable
+// from the newest readable header, unless a later one was written after
+// that header. Other keys keep the version at the highest offset.
+func Salvage(src, dst string, config Config) (*SalvageReport, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := st.Size()
+
+	old := &btree{file: f, config: config}
+	report := &SalvageReport{Comparator: config.Comparator}
+
+	// Use the comparator of the newest readable header, if any
+	if report.Comparator == "" {
+		h, _, err := old.find_header(size)
+		if err == nil {
+			report.Comparator = h.cmp
+		}
+	}
+	if report.Comparator == "" {
+		report.Comparator = DEFAULT_COMPARATOR
+	}
+
+	cmp, err := lookupComparator(report.Comparator)
+	if err != nil {
+		return nil, err
+	}
+
+	owners, current, latest, cmps := old.salvage_owners(size)
+	trees := map[string]map[string]salvaged{"": make(map[string]salvaged)}
+	add := func(name string, pos int64, nd *node) {
+		rank := rankOld
+		switch {
+		case latest >= 0 && pos > latest:
+			rank = rankNewer
+		case current[pos]:
+			rank = rankCurrent
+		}
+
+		if strings.HasPrefix(name, RESERVED_PREFIX) {
+			report.NodesDropped++
+		} else {
+			report.NodesFound++
+		}
+
+		items := trees[name]
+		if items == nil {
+			items = make(map[string]salvaged)
+			trees[name] = items
+		}
+
+		for _, itm := range nd.kvlist {
+			s, ok := items[string(itm.k)]
+			if !ok || s.rank < rank || s.rank == rank && s.pos < pos {
+				items[string(itm.k)] = salvaged{itm: itm, pos: pos, rank: rank}
+			}
+		}
+	}
+
+	var strays []strayNode
+	c := &salvageChunk{f: f, buf: make([]byte, SALVAGE_CHUNK), base: -1}
+	for pos := int64(0); pos < size; pos++ {
+		if c.base < 0 || pos >= c.base+int64(c.n) {
+			c.load(pos)
+		}
+		i := int(pos - c.base)
+		if i >= c.n {
+			break
+		}
+
+		flags := c.buf[i]
+		ntype := flags &^ nodeCompressed
+		if ntype != kvnode|nodeChecksum && ntype != kvnode && ntype != kpnode|nodeChecksum {
+			continue
+		}
+
+		// Check the encoded lengths and checksum before decoding
+		l := c.nodeLength(pos, size, flags)
+		if l == 0 || flags&nodeChecksum != 0 && !c.checksum(pos, l) {
+			continue
+		}
+
+		nd, err := old.readNodeChecked(pos, true)
+		if nd == nil {
+			continue
+		}
+
+		at := pos
+		name, owned := owners[at]
+		switch {
+		case err == nil:
+		case err != errNoChecksum || ntype != kvnode:
+			continue
+		case !owned && !sortedNode(nd, cmp):
+			continue
+		}
+
+		// Nodes inside this one are not real
+		pos += l - 1
+
+		switch {
+		case nd.ntype != kvnode:
+		case owned:
+			add(name, at, nd)
+		default:
+			strays = append(strays, strayNode{pos: at, nd: nd})
+		}
+	}
+
+	for _, s := range strays {
+		add(salvage_tree(trees, s.nd), s.pos, s.nd)
+	}
+
+	var names []string
+	for name := range trees {
+		if name != "" && !strings.HasPrefix(name, RESERVED_PREFIX) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	config.Comparator = report.Comparator
+	sorted := make(map[string][]*kv)
+	total := 0
+	for _, name := range append([]string{""}, names...) {
+		var kvs []*kv
+		for _, s := range trees[name] {
+			itm := s.itm
+			if itm.flags&kvBlob != 0 {
+				if len(itm.v) != 16 {
+					report.ValuesLost++
+					continue
+				}
+
+				v, err := old.readBlob(itm.v)
+				if err != nil {
+					report.ValuesLost++
+					continue
+				}
+				itm = &kv{k: itm.k, v: v, flags: itm.flags &^ kvBlob, expires: itm.expires}
+			}
+			kvs = append(kvs, itm)
+		}
+
+		c := cmp
+		if name != "" {
+			if cmps[name] == "" {
+				cmps[name] = DEFAULT_COMPARATOR
+			}
+			c, err = lookupComparator(cmps[name])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		sort.Slice(kvs, func(i, j int) bool {
+			return c(&kvs[i].k, &kvs[j].k) < 0
+		})
+		sorted[name] = kvs
+		total += len(kvs)
+	}
+
+	if total == 0 {
+		return report, errors.New("No items could be recovered")
+	}
+
+	nf, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return report, err
+	}
+
+	tree := &btree{
+		file:    nf,
+		config:  config,
+		cmpName: config.Comparator,
+	}
+	defer tree.Close()
+
+	err = tree.open(false)
+	if err == nil {
+		err = tree.build(sorted[""])
+	}
+
+	for _, name := range names {
+		var child *btree
+		if err == nil {
+			child, err = tree.named(name, cmps[name])
+		}
+		if err == nil {
+			err = child.build(sorted[name])
+		}
+	}
+
+	if err == nil {
+		err = tree.write_header()
+	}
+	if err != nil {
+		return report, err
+	}
+
+	report.KeysRecovered = total
+	report.Trees = names
+	return report, nil
+}
+
+// Keys of a node decoded without a checksum must be in order
+func sortedNode(nd *node, cmp func(*Key, *Key) int) bool {
+	for i := 1; i < len(nd.kvlist); i++ {
+		if cmp(&nd.kvlist[i-1].k, &nd.kvlist[i].k) >= 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Pick the tree for a node no header reaches, the one holding most of
+// its keys, or the default tree
+func salvage_tree(trees map[string]map[string]salvaged, nd *node) string {
+	best, most := "", 0
+	for name, items := range trees {
+		count := 0
+		for _, itm := range nd.kvlist {
+			if _, ok := items[string(itm.k)]; ok {
+				count++
+			}
+		}
+
+		if count > most || count == most && count > 0 && name < best {
+			best, most = name, count
+		}
+	}
+
+	return best
+}
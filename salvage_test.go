@@ -0,0 +1,241 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSalvage(t *testing.T) {
+	dst := TEST_FILE + ".salvage"
+	os.Remove(dst)
+	defer os.Remove(dst)
+
+	tree := initTree()
+	tree.cmpName = DEFAULT_COMPARATOR
+	tree.cmp, _ = lookupComparator(DEFAULT_COMPARATOR)
+	buildTestTree(tree, 1000)
+	tree.write_header()
+
+	err := tree.Insert(Key("key_0005"), Value("updated"))
+	if err != nil {
+		t.Fatalf("Insert failed (%s)", err)
+	}
+	tree.write_header()
+
+	// Destroy the latest header and everything from the top node on
+	top := v2p(tree.root.kvlist[0].v)
+	tree.file.WriteAt(bytes.Repeat([]byte{0xff}, int(tree.offset-top)), top)
+	tree.Close()
+
+	report, err := Salvage(TEST_FILE, dst, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Salvage failed (%s)", err)
+	}
+
+	if report.NodesFound == 0 || report.KeysRecovered != 1000 {
+		t.Errorf("Unexpected salvage report %+v", report)
+	}
+
+	tree, err = open_file(dst, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open salvaged file (%s)", err)
+	}
+	defer tree.Close()
+
+	v, err := tree.Get(Key("key_0005"))
+	if err != nil || string(v) != "updated" {
+		t.Errorf("Expected newest value, found %s (%v)", string(v), err)
+	}
+
+	v, err = tree.Get(Key("key_0999"))
+	if err != nil || string(v) != "val_999" {
+		t.Errorf("Unexpected value %s (%v)", string(v), err)
+	}
+
+	vreport, _ := tree.Verify(VerifyOptions{Checksums: true})
+	if !vreport.Ok() {
+		t.Errorf("Salvaged tree has violations %v", vreport.Violations)
+	}
+}
+
+func TestSalvageTrees(t *testing.T) {
+	dst := TEST_FILE + ".salvage"
+	os.Remove(TEST_FILE)
+	os.Remove(dst)
+	defer os.Remove(dst)
+
+	config := DefaultConfig()
+	config.TrackChanges = true
+	tree, err := open_file(TEST_FILE, config)
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+
+	users, _ := tree.Tree("users", "")
+	for i := 0; i < 100; i++ {
+		tree.Insert(make_key(i), make_value(i))
+		users.Insert(Key(fmt.Sprintf("user_%d", i)), make_value(i))
+	}
+	tree.Flush()
+
+	// Only reachable from the header destroyed below
+	tree.Insert(make_key(5), Value("updated"))
+	users.Insert(Key("user_5"), Value("updated"))
+	tree.Flush()
+
+	cur, end, _ := tree.committed()
+	tree.file.WriteAt(bytes.Repeat([]byte{0xff}, int(end-cur.Offset)), cur.Offset)
+	tree.Close()
+
+	report, err := Salvage(TEST_FILE, dst, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Salvage failed (%s)", err)
+	}
+
+	if report.KeysRecovered != 200 || !reflect.DeepEqual(report.Trees, []string{"users"}) {
+		t.Errorf("Unexpected salvage report %+v", report)
+	}
+
+	tree, err = open_file(dst, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open salvaged file (%s)", err)
+	}
+	defer tree.Close()
+
+	if len(tree.trees) != 1 {
+		t.Errorf("Expected only the users tree, found %v", tree.TreeNames())
+	}
+
+	users, _ = tree.Tree("users", "")
+	for name, tr := range map[string]Btree{"default": tree, "users": users} {
+		count := 0
+		tr.Scan(nil, nil, func(k Key, v Value) bool {
+			count++
+			if name == "users" != bytes.HasPrefix(k, []byte("user_")) {
+				t.Errorf("Key %s salvaged into the %s tree", string(k), name)
+			}
+			return true
+		})
+		if count != 100 {
+			t.Errorf("Expected 100 items in the %s tree, found %d", name, count)
+		}
+	}
+
+	v, _ := tree.Get(make_key(5))
+	v2, _ := users.Get(Key("user_5"))
+	if string(v) != "updated" || string(v2) != "updated" {
+		t.Errorf("Expected newest values, found %s and %s", string(v), string(v2))
+	}
+}
+
+func TestSalvageNoChecksums(t *testing.T) {
+	dst := TEST_FILE + ".salvage"
+	os.Remove(dst)
+	defer os.Remove(dst)
+
+	// Leaves of a file written before node checksums, without headers
+	tree := initTree()
+	for _, i := range []int{0, 5} {
+		var n node
+		n.ntype = kvnode
+		for j := i; j < i+5; j++ {
+			n.kvlist = append(n.kvlist, &kv{k: Key(fmt.Sprintf("key_%04d", j)), v: make_value(j)})
+		}
+		writeNodeNoChecksum(tree, &n)
+	}
+	tree.Close()
+
+	report, err := Salvage(TEST_FILE, dst, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Salvage failed (%s)", err)
+	}
+
+	if report.NodesFound != 2 || report.KeysRecovered != 10 {
+		t.Errorf("Unexpected salvage report %+v", report)
+	}
+}
+
+func TestSalvageWithoutHeaders(t *testing.T) {
+	N := 500
+	dst := TEST_FILE + ".salvage"
+	os.Remove(TEST_FILE)
+	os.Remove(dst)
+	defer os.Remove(dst)
+
+	tree, err := open_file(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+
+	// Keys and values shaped like by-sequence index entries
+	one := binary.LittleEndian.AppendUint64(nil, 1)
+	for i := 0; i < N; i++ {
+		tree.Insert(binary.BigEndian.AppendUint64(nil, uint64(i)), one)
+		tree.Flush()
+	}
+
+	versions, _ := tree.Versions()
+	for _, v := range versions {
+		tree.file.WriteAt(make([]byte, HEADER_SIZE), v.Offset)
+	}
+	tree.Close()
+
+	report, err := Salvage(TEST_FILE, dst, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Salvage failed (%s)", err)
+	}
+
+	// One leaf is rewritten per commit
+	if report.KeysRecovered != N || report.NodesDropped != 0 || report.NodesFound > 2*N {
+		t.Errorf("Unexpected salvage report %+v", report)
+	}
+}
+
+func TestSalvageRollback(t *testing.T) {
+	dst := TEST_FILE + ".salvage"
+	os.Remove(TEST_FILE)
+	os.Remove(dst)
+	defer os.Remove(dst)
+
+	tree, err := open_file(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		tree.Insert(make_key(i), make_value(i))
+	}
+	tree.Flush()
+	info, _ := tree.Info()
+	good := info.Version
+
+	tree.Insert(make_key(5), Value("BAD"))
+	tree.Flush()
+
+	err = tree.RollbackTo(good, false)
+	if err != nil {
+		t.Fatalf("Rollback failed (%s)", err)
+	}
+	tree.Close()
+
+	// Rolled back items are newer in the file but not current
+	_, err = Salvage(TEST_FILE, dst, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Salvage failed (%s)", err)
+	}
+
+	tree, err = open_file(dst, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open salvaged file (%s)", err)
+	}
+	defer tree.Close()
+
+	v, err := tree.Get(make_key(5))
+	if err != nil || string(v) != string(make_value(5)) {
+		t.Errorf("Expected rolled back value, found %s (%v)", string(v), err)
+	}
+}
@@ -0,0 +1,142 @@
+package btree
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type StructureOptions struct {
+	// Levels below the top node to descend, 0 for no limit
+	MaxDepth int
+	// Children shown per kpnode, 0 for no limit. Larger nodes are
+	// sampled at evenly spaced children, including the first and last.
+	MaxChildren int
+}
+
+// Node description emitted by DumpStructure. The key range is that of
+// the keys stored in the node, for kpnodes these are child separators.
+// As in dumps, non UTF-8 keys are base64 encoded in JSON.
+type nodeInfo struct {
+	Offset         int64       `json:"offset"`
+	Type           string      `json:"type"`
+	Items          int         `json:"items"`
+	FirstKey       string      `json:"first_key"`
+	LastKey        string      `json:"last_key"`
+	FirstKeyBase64 bool        `json:"first_key_base64,omitempty"`
+	LastKeyBase64  bool        `json:"last_key_base64,omitempty"`
+	Children       []*nodeInfo `json:"children,omitempty"`
+	// Children left out by depth or sampling limits
+	Omitted int `json:"omitted,omitempty"`
+	// Raw key range for DOT labels
+	first, last Key
+}
+
+// Indexes of the children to show, n of count evenly spaced
+func sampleChildren(count, n int) []int {
+	if n <= 0 || n >= count {
+		n = count
+	}
+
+	idx := make([]int, n)
+	for j := range idx {
+		if n > 1 {
+			idx[j] = j * (count - 1) / (n - 1)
+		}
+	}
+	return idx
+}
+
+func (tree *btree) describe_node(pos int64, depth int, opts StructureOptions) (*nodeInfo, error) {
+	n, err := tree.readNode(pos)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &nodeInfo{
+		Offset: pos,
+		Type:   nodeTypeName(n.ntype),
+		Items:  len(n.kvlist),
+	}
+
+	if len(n.kvlist) > 0 {
+		info.first = n.kvlist[0].k
+		info.last = n.kvlist[len(n.kvlist)-1].k
+		info.FirstKey, info.FirstKeyBase64 = encodeField(info.first)
+		info.LastKey, info.LastKeyBase64 = encodeField(info.last)
+	}
+
+	if n.ntype != kpnode {
+		return info, nil
+	}
+
+	if opts.MaxDepth > 0 && depth >= opts.MaxDepth {
+		info.Omitted = len(n.kvlist)
+		return info, nil
+	}
+
+	for _, i := range sampleChildren(len(n.kvlist), opts.MaxChildren) {
+		child, err := tree.describe_node(v2p(n.kvlist[i].v), depth+1, opts)
+		if err != nil {
+			return nil, err
+		}
+		info.Children = append(info.Children, child)
+	}
+	info.Omitted = len(n.kvlist) - len(info.Children)
+
+	return info, nil
+}
+
+func writeDot(w io.Writer, info *nodeInfo) {
+	fmt.Fprintf(w, "  n%d [label=%q];\n", info.Offset,
+		fmt.Sprintf("%s @%d\n%d items\n%q .. %q", info.Type, info.Offset, info.Items, info.first, info.last))
+
+	for _, child := range info.Children {
+		writeDot(w, child)
+		fmt.Fprintf(w, "  n%d -> n%d;\n", info.Offset, child.Offset)
+	}
+
+	if info.Omitted > 0 {
+		fmt.Fprintf(w, "  n%d_omitted [label=\"+%d more\", shape=plaintext];\n", info.Offset, info.Omitted)
+		fmt.Fprintf(w, "  n%d -> n%d_omitted [style=dashed];\n", info.Offset, info.Offset)
+	}
+}
+
+// Write the node layout of the current root as Graphviz DOT or JSON
+func (tree *btree) DumpStructure(w io.Writer, format int, opts StructureOptions) error {
+	if format != DUMP_DOT && format != DUMP_JSON {
+		return errors.New("Unknown structure format")
+	}
+
+	var info *nodeInfo
+	var err error
+	if tree.root != nil {
+		info, err = tree.describe_node(v2p(tree.root.kvlist[0].v), 0, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	switch format {
+	case DUMP_JSON:
+		enc := json.NewEncoder(bw)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(info)
+	case DUMP_DOT:
+		fmt.Fprintln(bw, "digraph btree {")
+		fmt.Fprintln(bw, "  node [shape=box];")
+		if info != nil {
+			writeDot(bw, info)
+		}
+		fmt.Fprintln(bw, "}")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
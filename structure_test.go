@@ -0,0 +1,97 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDumpStructure(t *testing.T) {
+	tree := initTree()
+	tree.cmp, _ = lookupComparator(DEFAULT_COMPARATOR)
+	buildTestTree(tree, 1000)
+
+	buf := new(bytes.Buffer)
+	err := tree.DumpStructure(buf, DUMP_JSON, StructureOptions{})
+	if err != nil {
+		t.Fatalf("DumpStructure failed (%s)", err)
+	}
+
+	var info nodeInfo
+	err = json.Unmarshal(buf.Bytes(), &info)
+	if err != nil {
+		t.Fatalf("Invalid JSON output (%s)", err)
+	}
+
+	items := 0
+	var walk func(n *nodeInfo)
+	walk = func(n *nodeInfo) {
+		if n.Type == "kvnode" {
+			items += n.Items
+		}
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+	walk(&info)
+
+	if items != 1000 || info.LastKey != "key_0999" {
+		t.Errorf("Unexpected structure: %d items, last key %s", items, info.LastKey)
+	}
+
+	buf.Reset()
+	err = tree.DumpStructure(buf, DUMP_DOT, StructureOptions{MaxDepth: 1, MaxChildren: 2})
+	if err != nil {
+		t.Fatalf("DumpStructure failed (%s)", err)
+	}
+
+	out := buf.String()
+	if !strings.HasPrefix(out, "digraph btree {") || !strings.Contains(out, "more") {
+		t.Errorf("Unexpected DOT output\n%s", out)
+	}
+
+	if tree.DumpStructure(buf, DUMP_BINARY, StructureOptions{}) == nil {
+		t.Errorf("Expected error for binary structure format")
+	}
+}
+
+func TestDumpStructureSampling(t *testing.T) {
+	tree := initTree()
+	tree.cmp, _ = lookupComparator(DEFAULT_COMPARATOR)
+	buildTestTree(tree, 1000)
+
+	rq := &ModifyRequest{
+		ops: []Operation{
+			Operation{itm: kv{k: Key("\xff\xfe"), v: Value("v")}, op: OP_INSERT},
+		},
+	}
+	tree.modify(rq)
+
+	buf := new(bytes.Buffer)
+	err := tree.DumpStructure(buf, DUMP_JSON, StructureOptions{MaxChildren: 3})
+	if err != nil {
+		t.Fatalf("DumpStructure failed (%s)", err)
+	}
+
+	var info nodeInfo
+	err = json.Unmarshal(buf.Bytes(), &info)
+	if err != nil {
+		t.Fatalf("Invalid JSON output (%s)", err)
+	}
+
+	if len(info.Children) != 3 || info.Omitted != info.Items-3 {
+		t.Fatalf("Expected 3 sampled children of %d, found %d", info.Items, len(info.Children))
+	}
+
+	// Samples span the node, up to the binary last key
+	last := info.Children[2]
+	if info.Children[0].LastKey != info.FirstKey || !last.LastKeyBase64 || last.LastKey != info.LastKey {
+		t.Errorf("Unexpected samples %+v .. %+v", info.Children[0], last)
+	}
+
+	k, _ := decodeField(info.LastKey, info.LastKeyBase64)
+	if string(k) != "\xff\xfe" {
+		t.Errorf("Expected base64 encoded last key, found %q", info.LastKey)
+	}
+}
@@ -17,7 +17,7 @@ func initTree() *btree {
 	tree := &btree{
 		file:   f,
 		offset: 0,
-		config: Config{KV_CHUNKSIZE, KP_CHUNKSIZE},
+		config: Config{kvChunkSize: KV_CHUNKSIZE, kpChunkSize: KP_CHUNKSIZE},
 	}
 
 	return tree
@@ -28,7 +28,7 @@ func openTree() *btree {
 	tree := &btree{
 		file:   f,
 		offset: 0,
-		config: Config{KV_CHUNKSIZE, KP_CHUNKSIZE},
+		config: Config{kvChunkSize: KV_CHUNKSIZE, kpChunkSize: KP_CHUNKSIZE},
 	}
 
 	return tree
@@ -48,3 +48,13 @@ func equals(itm1, itm2 kv) bool {
 	}
 	return false
 }
+
+// Order keys created by make_key numerically
+func compareKeyIds(k1, k2 Key) int {
+	i1 := 0
+	i2 := 0
+	fmt.Sscanf(string(k1), "key_%d", &i1)
+	fmt.Sscanf(string(k2), "key_%d", &i2)
+
+	return i1 - i2
+}
@@ -0,0 +1,70 @@
+package btree
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Marker left for a deleted key in tombstone mode
+type Tombstone struct {
+	Key Key
+	// Sequence number of the delete, 0 if changes are not tracked
+	Seq     uint64
+	Deleted time.Time
+}
+
+func newTombstone(k Key, seq uint64) *kv {
+	v := make(Value, 16)
+	binary.LittleEndian.PutUint64(v, uint64(timeNow().UnixNano()))
+	binary.LittleEndian.PutUint64(v[8:], seq)
+	return &kv{k: k, v: v, flags: kvTombstone}
+}
+
+func decodeTombstone(itm *kv) Tombstone {
+	return Tombstone{
+		Key:     itm.k,
+		Seq:     binary.LittleEndian.Uint64(itm.v[8:]),
+		Deleted: time.Unix(0, int64(binary.LittleEndian.Uint64(itm.v))),
+	}
+}
+
+// Return a filter that drops tombstones older than the retention on
+// compaction, nil if they are kept
+func (tree *btree) purge_filter() func(*kv) bool {
+	if tree.config.TombstoneRetention == 0 {
+		return nil
+	}
+
+	limit := timeNow().Add(-tree.config.TombstoneRetention)
+	return func(itm *kv) bool {
+		return !itm.tombstone() || decodeTombstone(itm).Deleted.After(limit)
+	}
+}
+
+// Call fn for tombstones of keys between start and end inclusive, in
+// key order, until it returns false. A nil start or end leaves the
+// range open.
+func (tree *btree) Tombstones(start, end Key, fn func(Tombstone) bool) error {
+	keys := []*Key{nil, nil}
+	if start != nil {
+		keys[0] = &start
+	}
+	if end != nil {
+		keys[1] = &end
+	}
+
+	var rq *QueryRequest
+	rq = &QueryRequest{
+		Keys: keys,
+		Callback: func(itm kv) {
+			if !rq.stop && itm.tombstone() && !fn(decodeTombstone(&itm)) {
+				rq.stop = true
+			}
+		},
+		Range:      true,
+		raw:        true,
+		tombstones: true,
+	}
+
+	return tree.query(rq)
+}
@@ -0,0 +1,109 @@
+package btree
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTombstones(t *testing.T) {
+	now := time.Unix(1000, 0)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	os.Remove(TEST_FILE)
+	defer os.Remove(TEST_FILE)
+
+	config := DefaultConfig()
+	config.Tombstones = true
+	config.TrackChanges = true
+	tree, err := open_file(TEST_FILE, config)
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		tree.Insert(make_key(i), make_value(i))
+	}
+	tree.Flush()
+	versions, _ := tree.Versions()
+	old := versions[0]
+
+	tree.Remove(make_key(2))
+	tree.Remove(make_key(9))
+	tree.Flush()
+	versions, _ = tree.Versions()
+
+	if _, err = tree.Get(make_key(2)); err != ErrNotFound {
+		t.Errorf("Expected deleted key to be hidden (%v)", err)
+	}
+
+	var tombs []Tombstone
+	tree.Tombstones(nil, nil, func(ts Tombstone) bool {
+		tombs = append(tombs, ts)
+		return true
+	})
+	if len(tombs) != 1 || string(tombs[0].Key) != string(make_key(2)) ||
+		tombs[0].Seq != 6 || !tombs[0].Deleted.Equal(now) {
+		t.Errorf("Unexpected tombstones %v", tombs)
+	}
+
+	var diffs []DiffEntry
+	tree.Diff(old, versions[0], func(e DiffEntry) bool {
+		diffs = append(diffs, e)
+		return true
+	})
+	if len(diffs) != 1 || diffs[0].Type != DIFF_REMOVED {
+		t.Errorf("Expected removal in diff, found %v", diffs)
+	}
+
+	ok, _ := tree.PutIfAbsent(make_key(2), make_value(20))
+	if !ok {
+		t.Error("Expected PutIfAbsent over a tombstone to succeed")
+	}
+	tree.Flush()
+	tree.Close()
+
+	// Tombstone mode is kept by the file
+	tree, err = open_file(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to reopen tree (%s)", err)
+	}
+	defer tree.Close()
+
+	tree.Remove(make_key(3))
+	tree.Flush()
+	now = now.Add(time.Hour)
+	tree.Remove(make_key(4))
+	tree.Flush()
+
+	info, _ := tree.Info()
+	if info.Tombstones != 2 {
+		t.Errorf("Expected 2 tombstones, found %d", info.Tombstones)
+	}
+
+	// Only tombstones older than the retention are purged
+	tree.config.TombstoneRetention = 30 * time.Minute
+	err = tree.Compact()
+	if err != nil {
+		t.Fatalf("Compact failed (%s)", err)
+	}
+
+	tombs = nil
+	tree.Tombstones(nil, nil, func(ts Tombstone) bool {
+		tombs = append(tombs, ts)
+		return true
+	})
+	if len(tombs) != 1 || string(tombs[0].Key) != string(make_key(4)) {
+		t.Errorf("Expected only the recent tombstone to remain, found %v", tombs)
+	}
+
+	count := 0
+	tree.Scan(nil, nil, func(k Key, v Value) bool {
+		count++
+		return true
+	})
+	if count != 3 {
+		t.Errorf("Expected 3 live items, found %d", count)
+	}
+}
@@ -0,0 +1,171 @@
+package btree
+
+import (
+	"errors"
+	"sort"
+)
+
+// Attempts of an update before giving up with ErrConflict
+const TX_RETRIES = 3
+
+var ErrConflict = errors.New("Transaction conflicts with a concurrent commit")
+
+// Optimistic transaction. Reads see the tree as of the start of the
+// transaction, writes are buffered until commit.
+type Tx struct {
+	tree *btree
+	snap *btree
+	// Offset of the leaf holding each key read, -1 for an empty tree
+	reads  map[string]int64
+	writes map[string]Operation
+}
+
+// Look up an item without resolving blobs, nil if absent
+func (tree *btree) lookup(k Key) (*kv, error) {
+	var found *kv
+
+	rq := &QueryRequest{
+		Keys: []*Key{&k},
+		Callback: func(itm kv) {
+			if !itm.missing {
+				found = &itm
+			}
+		},
+		raw: true,
+	}
+
+	err := tree.query(rq)
+	return found, err
+}
+
+// Offset of the leaf that holds k, or would hold it. Leaves are
+// rewritten whenever an item in them changes, so an unchanged offset
+// means the key was not modified.
+func (tree *btree) leaf_pos(k Key) (int64, error) {
+	if tree.root == nil {
+		return -1, nil
+	}
+
+	pos := v2p(tree.root.kvlist[0].v)
+	for {
+		n, err := tree.readNode(pos)
+		if err != nil {
+			return 0, err
+		}
+		if n.ntype == kvnode {
+			return pos, nil
+		}
+
+		i := sort.Search(len(n.kvlist)-1, func(i int) bool {
+			return tree.cmp(&n.kvlist[i].k, &k) >= 0
+		})
+		pos = v2p(n.kvlist[i].v)
+	}
+}
+
+func (tx *Tx) Get(k Key) (Value, error) {
+	if op, ok := tx.writes[string(k)]; ok {
+		if op.op == OP_DELETE {
+			return nil, ErrNotFound
+		}
+		return op.itm.v, nil
+	}
+
+	itm, err := tx.snap.lookup(k)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := tx.reads[string(k)]; !ok {
+		pos, err := tx.snap.leaf_pos(k)
+		if err != nil {
+			return nil, err
+		}
+		tx.reads[string(k)] = pos
+	}
+
+	if itm == nil {
+		return nil, ErrNotFound
+	}
+
+	return tx.snap.resolve(itm)
+}
+
+func (tx *Tx) Insert(k Key, v Value) {
+	tx.writes[string(k)] = Operation{itm: kv{k: k, v: v}, op: OP_INSERT}
+}
+
+func (tx *Tx) Remove(k Key) {
+	tx.writes[string(k)] = Operation{itm: kv{k: k}, op: OP_DELETE}
+}
+
+// Check that the leaves holding the keys read were not rewritten since
+// the snapshot, then apply the writes and commit them
+func (tx *Tx) commit() error {
+	tree := tx.tree
+	for k, old := range tx.reads {
+		cur, err := tree.leaf_pos(Key(k))
+		if err != nil {
+			return err
+		}
+
+		if cur != old {
+			return ErrConflict
+		}
+	}
+
+	if len(tx.writes) == 0 {
+		return nil
+	}
+
+	rq := &ModifyRequest{}
+	for _, op := range tx.writes {
+		rq.ops = append(rq.ops, op)
+	}
+	sort.Slice(rq.ops, func(i, j int) bool {
+		return tree.cmp(&rq.ops[i].itm.k, &rq.ops[j].itm.k) < 0
+	})
+
+	err := tree.modify(rq)
+	if err != nil {
+		return err
+	}
+
+	return tree.write_header()
+}
+
+// Run fn in a transaction and commit its writes if fn returns nil.
+// The commit conflicts if a leaf holding a key read by fn was rewritten
+// by another commit in the meantime, even for changes to other keys,
+// and fn is retried. ErrConflict is returned after TX_RETRIES attempts.
+// Updates are serialized against each other, other writes and
+// compaction must not run concurrently.
+func (tree *btree) Update(fn func(tx *Tx) error) error {
+	o := tree.owner()
+
+	for i := 0; i < TX_RETRIES; i++ {
+		o.txLock.Lock()
+		tx := &Tx{
+			tree:   tree,
+			snap:   tree.snapshot(),
+			reads:  make(map[string]int64),
+			writes: make(map[string]Operation),
+		}
+		o.txLock.Unlock()
+
+		err := fn(tx)
+		if err != nil {
+			return err
+		}
+
+		o.txLock.Lock()
+		err = tx.commit()
+		o.txLock.Unlock()
+
+		if err != ErrConflict {
+			return err
+		}
+	}
+
+	return ErrConflict
+}
@@ -0,0 +1,132 @@
+package btree
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpdate(t *testing.T) {
+	os.Remove(TEST_FILE)
+	defer os.Remove(TEST_FILE)
+
+	tree, err := Open(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+	defer tree.Close()
+
+	counter := Key("counter")
+	tree.Insert(counter, Value("0"))
+	tree.Flush()
+
+	// Concurrent increments are serialized by retrying on conflict
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; {
+				err := tree.Update(func(tx *Tx) error {
+					v, err := tx.Get(counter)
+					if err != nil {
+						return err
+					}
+					n, _ := strconv.Atoi(string(v))
+					tx.Insert(counter, Value(strconv.Itoa(n+1)))
+					return nil
+				})
+				if err == nil {
+					j++
+				} else if err != ErrConflict {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Update failed (%s)", err)
+	}
+
+	v, _ := tree.Get(counter)
+	if string(v) != "80" {
+		t.Errorf("Expected counter 80, found %s", v)
+	}
+
+	// A commit after the read makes the attempt conflict
+	attempts := 0
+	err = tree.Update(func(tx *Tx) error {
+		attempts++
+		_, err := tx.Get(make_key(1))
+		if attempts == 1 && err != ErrNotFound {
+			t.Errorf("Expected missing key (%v)", err)
+		}
+		if attempts == 1 {
+			tree.Insert(make_key(1), make_value(1))
+			tree.Flush()
+		}
+		tx.Insert(make_key(2), make_value(2))
+		tx.Remove(counter)
+		if _, err := tx.Get(counter); err != ErrNotFound {
+			t.Errorf("Expected buffered remove to be visible (%v)", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Expected update to succeed on retry (%v)", err)
+	}
+	if attempts != 2 {
+		t.Errorf("Expected 2 attempts, found %d", attempts)
+	}
+	if _, err = tree.Get(counter); err != ErrNotFound {
+		t.Errorf("Expected counter to be removed (%v)", err)
+	}
+
+	attempts = 0
+	err = tree.Update(func(tx *Tx) error {
+		attempts++
+		tx.Get(make_key(3))
+		tree.Insert(make_key(3), make_value(attempts))
+		return nil
+	})
+	if err != ErrConflict || attempts != TX_RETRIES {
+		t.Errorf("Expected conflict after %d attempts, found %d (%v)", TX_RETRIES, attempts, err)
+	}
+
+	// Changes since the snapshot conflict even if the value ends up
+	// the same, or only the expiry changed
+	for name, change := range map[string]func(){
+		"A-B-A": func() {
+			tree.Insert(make_key(4), make_value(5))
+			tree.Flush()
+			tree.Insert(make_key(4), make_value(4))
+			tree.Flush()
+		},
+		"expiry": func() {
+			tree.InsertWithTTL(make_key(4), make_value(4), time.Hour)
+			tree.Flush()
+		},
+	} {
+		tree.Insert(make_key(4), make_value(4))
+		tree.Flush()
+
+		attempts = 0
+		err = tree.Update(func(tx *Tx) error {
+			attempts++
+			tx.Get(make_key(4))
+			if attempts == 1 {
+				change()
+			}
+			return nil
+		})
+		if err != nil || attempts != 2 {
+			t.Errorf("Expected %s change to conflict once, found %d attempts (%v)", name, attempts, err)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package btree
+
+import (
+	"fmt"
+)
+
+type VerifyOptions struct {
+	// Check the checksum of every reachable node that has one. Nodes
+	// written before checksums were added are counted as unchecked.
+	Checksums bool
+}
+
+// Invariant violation found by Verify
+type Violation struct {
+	Offset   int64
+	NodeType string
+	Problem  string
+	Expected string
+	Actual   string
+}
+
+func (v Violation) String() string {
+	s := fmt.Sprintf("%d (%s): %s", v.Offset, v.NodeType, v.Problem)
+	if v.Expected != "" || v.Actual != "" {
+		s += fmt.Sprintf(", expected %q, found %q", v.Expected, v.Actual)
+	}
+	return s
+}
+
+type VerifyReport struct {
+	// Header offset of the verified version
+	Version Version
+	Depth   int
+	Nodes   int
+	Items   int
+	// Nodes without a checksum, counted only with Checksums
+	Unchecked  int
+	Violations []Violation
+}
+
+func (r *VerifyReport) Ok() bool {
+	return len(r.Violations) == 0
+}
+
+type verifier struct {
+	tree   *btree
+	opts   VerifyOptions
+	report *VerifyReport
+	// Nodes must be written before the header
+	limit int64
+}
+
+func nodeTypeName(ntype int8) string {
+	switch ntype {
+	case kvnode:
+		return "kvnode"
+	case kpnode:
+		return "kpnode"
+	}
+
+	return fmt.Sprintf("unknown(%d)", ntype)
+}
+
+func (v *verifier) violation(pos int64, ntype string, problem, expected, actual string) {
+	v.report.Violations = append(v.report.Violations, Violation{
+		Offset:   pos,
+		NodeType: ntype,
+		Problem:  problem,
+		Expected: expected,
+		Actual:   actual,
+	})
+}
+
+// Check structural invariants of the latest committed version. All
+// violations found are collected in the report, an error is returned
+// only if no committed version could be found.
+func (tree *btree) Verify(opts VerifyOptions) (*VerifyReport, error) {
+	o := tree.owner()
+	h, pos, err := o.find_header(o.offset)
+	if err != nil {
+		return nil, err
+	}
+
+	// Named trees are verified from their catalog entry
+	rootptr := h.rootptr
+	if tree.parent != nil {
+		rootptr = EMPTY_ROOT
+		for _, e := range h.trees {
+			if e.name == tree.name {
+				rootptr = e.rootptr
+			}
+		}
+	}
+
+	v := &verifier{
+		tree:   tree,
+		opts:   opts,
+		report: &VerifyReport{Version: Version{o.generation, pos}, Depth: -1},
+		limit:  pos,
+	}
+
+	if rootptr == EMPTY_ROOT {
+		v.report.Depth = 0
+		return v.report, nil
+	}
+
+	if rootptr < 0 || rootptr >= pos {
+		v.violation(rootptr, "header", "root pointer beyond header", fmt.Sprint("<", pos), fmt.Sprint(rootptr))
+		return v.report, nil
+	}
+
+	v.verify_node(rootptr, 0, nil, nil)
+
+	return v.report, nil
+}
+
+// Verify subtree at pos. Its keys must be greater than lower, and
+// the last one must equal the separator key of the parent.
+func (v *verifier) verify_node(pos int64, depth int, lower, sep *Key) {
+	tree := v.tree
+	n, err := tree.readNodeChecked(pos, v.opts.Checksums)
+	if n == nil {
+		v.violation(pos, "", "unreadable node", "", err.Error())
+		return
+	}
+
+	ntype := nodeTypeName(n.ntype)
+	switch {
+	case err == errNoChecksum:
+		v.report.Unchecked++
+	case err != nil:
+		v.violation(pos, ntype, err.Error(), "", "")
+	}
+
+	v.report.Nodes++
+	if len(n.kvlist) == 0 {
+		v.violation(pos, ntype, "empty node", "", "")
+		return
+	}
+
+	for i, itm := range n.kvlist {
+		switch {
+		case i > 0 && tree.cmp(&n.kvlist[i-1].k, &itm.k) >= 0:
+			v.violation(pos, ntype, "keys out of order",
+				"> "+string(n.kvlist[i-1].k), string(itm.k))
+		case i == 0 && lower != nil && tree.cmp(lower, &itm.k) >= 0:
+			v.violation(pos, ntype, "key not above previous separator",
+				"> "+string(*lower), string(itm.k))
+		}
+	}
+
+	last := &n.kvlist[len(n.kvlist)-1].k
+	if sep != nil && tree.cmp(last, sep) != 0 {
+		v.violation(pos, ntype, "max key differs from parent separator", string(*sep), string(*last))
+	}
+
+	switch n.ntype {
+	case kvnode:
+		v.report.Items += len(n.kvlist)
+		switch {
+		case v.report.Depth < 0:
+			v.report.Depth = depth
+		case v.report.Depth != depth:
+			v.violation(pos, ntype, "inconsistent leaf depth",
+				fmt.Sprint(v.report.Depth), fmt.Sprint(depth))
+		}
+
+		for _, itm := range n.kvlist {
+			if itm.flags&kvBlob == 0 {
+				continue
+			}
+
+			if len(itm.v) != 16 {
+				v.violation(pos, ntype, "invalid blob pointer", "16 bytes", fmt.Sprint(len(itm.v)))
+				continue
+			}
+
+			end := v2p(itm.v[:8]) + v2p(itm.v[8:])
+			if end > v.limit {
+				v.violation(pos, ntype, "blob pointer beyond header", fmt.Sprint("<= ", v.limit), fmt.Sprint(end))
+			}
+		}
+
+	case kpnode:
+		for i, itm := range n.kvlist {
+			child := v2p(itm.v)
+			if child < 0 || child >= pos {
+				v.violation(pos, ntype, "child pointer not below node", fmt.Sprint("< ", pos), fmt.Sprint(child))
+				continue
+			}
+
+			var lo *Key
+			if i > 0 {
+				lo = &n.kvlist[i-1].k
+			} else {
+				lo = lower
+			}
+			v.verify_node(child, depth+1, lo, &itm.k)
+		}
+
+	default:
+		v.violation(pos, ntype, "invalid node type", "", "")
+	}
+}
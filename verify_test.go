@@ -0,0 +1,112 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	tree := initTree()
+	tree.cmp, _ = lookupComparator(DEFAULT_COMPARATOR)
+	buildTestTree(tree, 1000)
+	tree.write_header()
+
+	report, err := tree.Verify(VerifyOptions{Checksums: true})
+	if err != nil {
+		t.Fatalf("Verify failed (%s)", err)
+	}
+
+	if !report.Ok() {
+		t.Fatalf("Unexpected violations %v", report.Violations)
+	}
+
+	if report.Items != 1000 {
+		t.Errorf("Expected 1000 items, found %d", report.Items)
+	}
+
+	// Unsorted leaf under a new root
+	var n node
+	n.ntype = kvnode
+	n.kvlist = []*kv{&kv{k: Key("b"), v: Value("1")}, &kv{k: Key("a"), v: Value("2")}}
+	pos, _ := tree.writeNode(&n)
+	tree.root = &node{ntype: kpnode, kvlist: []*kv{&kv{k: Key("b"), v: p2v(pos)}}}
+	tree.write_header()
+
+	report, _ = tree.Verify(VerifyOptions{})
+	if report.Ok() || !strings.Contains(report.Violations[0].Problem, "out of order") {
+		t.Errorf("Expected out of order violation, found %v", report.Violations)
+	}
+
+	// Corrupt a byte inside the leaf
+	tree.file.WriteAt([]byte("z"), pos+9)
+	report, _ = tree.Verify(VerifyOptions{})
+	for _, v := range report.Violations {
+		if strings.Contains(v.Problem, "checksum") {
+			t.Errorf("Checksums verified without option")
+		}
+	}
+
+	report, _ = tree.Verify(VerifyOptions{Checksums: true})
+	found := false
+	for _, v := range report.Violations {
+		if v.Offset == pos && strings.Contains(v.Problem, "checksum mismatch") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected checksum violation, found %v", report.Violations)
+	}
+}
+
+// Write a node the way files did before node checksums
+func writeNodeNoChecksum(tree *btree, n *node) int64 {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, n.ntype)
+	binary.Write(buf, binary.LittleEndian, uint32(len(n.kvlist)))
+	for _, itm := range n.kvlist {
+		buf.Write(itm.Bytes())
+	}
+
+	pos := tree.offset
+	tree.file.WriteAt(buf.Bytes(), pos)
+	tree.offset += int64(buf.Len())
+	return pos
+}
+
+func TestVerifyNoChecksums(t *testing.T) {
+	defer os.Remove(RESTORE_FILE)
+
+	tree := initTree()
+	tree.cmpName = DEFAULT_COMPARATOR
+	tree.cmp, _ = lookupComparator(DEFAULT_COMPARATOR)
+
+	var n node
+	n.ntype = kvnode
+	n.kvlist = []*kv{&kv{k: Key("a"), v: Value("1")}, &kv{k: Key("b"), v: Value("2")}}
+	pos := writeNodeNoChecksum(tree, &n)
+	tree.root = &node{ntype: kpnode, kvlist: []*kv{&kv{k: Key("b"), v: p2v(pos)}}}
+	tree.write_header()
+
+	report, err := tree.Verify(VerifyOptions{Checksums: true})
+	if err != nil {
+		t.Fatalf("Verify failed (%s)", err)
+	}
+	if !report.Ok() || report.Unchecked != 1 {
+		t.Errorf("Expected one unchecked node and no violations, found %d %v", report.Unchecked, report.Violations)
+	}
+
+	buf := new(bytes.Buffer)
+	_, err = tree.Backup(buf)
+	if err != nil {
+		t.Fatalf("Backup failed (%s)", err)
+	}
+
+	os.Remove(RESTORE_FILE)
+	_, err = RestoreBackup(RESTORE_FILE, DefaultConfig(), buf)
+	if err != nil {
+		t.Errorf("Restoring a file without node checksums failed (%s)", err)
+	}
+}
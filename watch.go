@@ -0,0 +1,176 @@
+package btree
+
+import (
+	"context"
+)
+
+// Event types
+const (
+	EVENT_INSERT = iota
+	EVENT_UPDATE
+	EVENT_DELETE
+	// Events were dropped, the watched range should be read again
+	EVENT_RESYNC
+)
+
+// Events buffered per watcher before a slow consumer loses events
+const WATCH_BUFSIZE = 256
+
+// Committed change delivered to watchers
+type Event struct {
+	Type  int
+	Key   Key
+	Value Value
+	// Version of the commit that made the change
+	Version Version
+}
+
+// Keys between Start and End inclusive, nil leaves the range open
+type KeyRange struct {
+	Start Key
+	End   Key
+}
+
+type watcher struct {
+	keys KeyRange
+	ch   chan Event
+	done chan struct{}
+}
+
+func (tree *btree) in_range(k Key, r KeyRange) bool {
+	if r.Start != nil && tree.cmp(&k, &r.Start) < 0 {
+		return false
+	}
+
+	return r.End == nil || tree.cmp(&k, &r.End) <= 0
+}
+
+// Subscribe to changes of keys in a range. Events are delivered after
+// the commit that made them, until ctx is done or the tree is closed,
+// when the channel is closed. A consumer that falls more than
+// WATCH_BUFSIZE events behind loses events, and receives a single
+// EVENT_RESYNC once there is room again.
+func (tree *btree) Watch(ctx context.Context, keys KeyRange) <-chan Event {
+	w := &watcher{
+		keys: keys,
+		// One extra slot is kept for the resync marker
+		ch:   make(chan Event, WATCH_BUFSIZE+1),
+		done: make(chan struct{}),
+	}
+
+	tree.watchLock.Lock()
+	tree.watchers = append(tree.watchers, w)
+	tree.watchLock.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			tree.remove_watcher(w)
+		case <-w.done:
+		}
+	}()
+
+	return w.ch
+}
+
+func (tree *btree) remove_watcher(w *watcher) {
+	tree.watchLock.Lock()
+	defer tree.watchLock.Unlock()
+
+	for i, x := range tree.watchers {
+		if x == w {
+			tree.watchers = append(tree.watchers[:i], tree.watchers[i+1:]...)
+			close(w.ch)
+			close(w.done)
+			return
+		}
+	}
+}
+
+func (tree *btree) close_watchers() {
+	tree.watchLock.Lock()
+	defer tree.watchLock.Unlock()
+
+	for _, w := range tree.watchers {
+		close(w.ch)
+		close(w.done)
+	}
+	tree.watchers = nil
+	tree.events = nil
+}
+
+// Queue events for the applied operations of a modify request
+func (tree *btree) queue_events(rq *ModifyRequest) {
+	tree.watchLock.Lock()
+	defer tree.watchLock.Unlock()
+
+	if len(tree.watchers) == 0 {
+		return
+	}
+
+	for _, op := range rq.ops {
+		e := Event{Key: op.itm.k}
+		switch {
+		case !op.applied:
+			continue
+		case op.deletes():
+			e.Type = EVENT_DELETE
+		case op.found:
+			e.Type = EVENT_UPDATE
+			e.Value = op.itm.v
+		default:
+			e.Type = EVENT_INSERT
+			e.Value = op.itm.v
+		}
+
+		tree.events = append(tree.events, e)
+	}
+}
+
+// Make every watcher resync after the next commit
+func (tree *btree) resync_watchers() {
+	tree.watchLock.Lock()
+	defer tree.watchLock.Unlock()
+
+	if len(tree.watchers) > 0 {
+		tree.events = append(tree.events, Event{Type: EVENT_RESYNC})
+	}
+}
+
+// Deliver queued events as part of a committed version
+func (tree *btree) publish(version Version) {
+	tree.watchLock.Lock()
+	defer tree.watchLock.Unlock()
+
+	for _, w := range tree.watchers {
+		resync := false
+		for _, e := range tree.events {
+			if e.Type == EVENT_RESYNC {
+				resync = true
+				continue
+			}
+
+			if !tree.in_range(e.Key, w.keys) {
+				continue
+			}
+
+			if len(w.ch) >= WATCH_BUFSIZE {
+				resync = true
+				continue
+			}
+
+			e.Version = version
+			w.ch <- e
+		}
+
+		// The channel is full only if an unread marker is in it already
+		if resync {
+			select {
+			case w.ch <- Event{Type: EVENT_RESYNC, Version: version}:
+			default:
+			}
+		}
+	}
+
+	tree.events = nil
+}
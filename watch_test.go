@@ -0,0 +1,74 @@
+package btree
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestWatch(t *testing.T) {
+	os.Remove(TEST_FILE)
+	defer os.Remove(TEST_FILE)
+
+	tree, err := Open(TEST_FILE, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open tree (%s)", err)
+	}
+	defer tree.Close()
+
+	tree.Insert(make_key(1), make_value(1))
+	tree.Flush()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := tree.Watch(ctx, KeyRange{Start: make_key(1), End: make_key(3)})
+
+	tree.Insert(make_key(1), make_value(10))
+	tree.Insert(make_key(2), make_value(2))
+	tree.Insert(make_key(5), make_value(5))
+	tree.Remove(make_key(4))
+	tree.Remove(make_key(2))
+
+	if len(ch) != 0 {
+		t.Errorf("Expected no events before commit, found %d", len(ch))
+	}
+
+	tree.Flush()
+	versions, _ := tree.Versions()
+
+	expected := []Event{
+		{Type: EVENT_UPDATE, Key: make_key(1), Value: make_value(10)},
+		{Type: EVENT_INSERT, Key: make_key(2), Value: make_value(2)},
+		{Type: EVENT_DELETE, Key: make_key(2)},
+	}
+	if len(ch) != len(expected) {
+		t.Fatalf("Expected %d events, found %d", len(expected), len(ch))
+	}
+	for _, exp := range expected {
+		e := <-ch
+		exp.Version = versions[0]
+		if e.Type != exp.Type || string(e.Key) != string(exp.Key) ||
+			string(e.Value) != string(exp.Value) || e.Version != exp.Version {
+			t.Errorf("Expected event %v, found %v", exp, e)
+		}
+	}
+
+	// A slow consumer gets a resync marker after the buffered events
+	for i := 0; i < WATCH_BUFSIZE+10; i++ {
+		tree.Insert(make_key(2), make_value(i))
+	}
+	tree.Flush()
+
+	if len(ch) != WATCH_BUFSIZE+1 {
+		t.Fatalf("Expected full buffer and marker, found %d events", len(ch))
+	}
+	for i := 0; i < WATCH_BUFSIZE; i++ {
+		<-ch
+	}
+	if e := <-ch; e.Type != EVENT_RESYNC {
+		t.Errorf("Expected resync marker, found %v", e)
+	}
+
+	cancel()
+	for range ch {
+	}
+}